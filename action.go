@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// output still open this long after action.sh exited, e.g. held by
+	// a daemon it started, is no longer waited for
+	actionWaitDelay = 2 * time.Second
+	// longer lines are passed on in pieces of this size
+	actionMaxLine = 64 * 1024
+)
+
+// actionLine is one line of `apd module action --json` output. The last
+// line carries the exit code instead of output.
+type actionLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream,omitempty"`
+	Line   string    `json:"line"`
+	Exit   *int      `json:"exit,omitempty"`
+}
+
+type actionOutput struct {
+	mu        sync.Mutex
+	jsonLines bool
+	encoder   *json.Encoder
+}
+
+func (o *actionOutput) write(stream, line string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.jsonLines {
+		o.encoder.Encode(actionLine{Time: time.Now(), Stream: stream, Line: line})
+		return
+	}
+	if stream == "stderr" {
+		fmt.Fprintln(os.Stderr, line)
+	} else {
+		fmt.Fprintln(os.Stdout, line)
+	}
+}
+
+func (o *actionOutput) exit(code int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.jsonLines {
+		o.encoder.Encode(actionLine{Time: time.Now(), Exit: &code})
+	}
+}
+
+// actionStream splits what the script writes to one stream into lines.
+// It is the command's Stdout or Stderr, so cmd.Wait returns once the
+// script has exited and the output was copied, or after WaitDelay.
+type actionStream struct {
+	emit   func(stream, line string)
+	stream string
+	buf    []byte
+}
+
+func (s *actionStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.emit(s.stream, string(bytes.TrimSuffix(s.buf[:i], []byte("\r"))))
+		s.buf = s.buf[i+1:]
+	}
+	for len(s.buf) >= actionMaxLine {
+		s.emit(s.stream, string(s.buf[:actionMaxLine]))
+		s.buf = s.buf[actionMaxLine:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a last line that did not end in a newline.
+func (s *actionStream) flush() {
+	if len(s.buf) > 0 {
+		s.emit(s.stream, string(s.buf))
+		s.buf = nil
+	}
+}
+
+// checkModuleAction makes sure the module exists, is enabled and ships an
+// action.sh, and returns the script path.
+func checkModuleAction(id string) (string, error) {
+	if err := checkModuleID(id); err != nil {
+		return "", err
+	}
+	state := readModuleState(id)
+	switch {
+	case !state.Installed:
+		return "", fmt.Errorf("module %s not found", id)
+	case state.Disabled:
+		return "", fmt.Errorf("module %s is disabled", id)
+	case state.Remove:
+		return "", fmt.Errorf("module %s is pending removal", id)
+	}
+	script := filepath.Join(moduleDir, id, moduleActionSh)
+	if !fileExists(script) {
+		return "", fmt.Errorf("module %s has no %s", id, moduleActionSh)
+	}
+	return script, nil
+}
+
+// runModuleAction runs the module's action.sh in the foreground, streaming
+// its output line by line and forwarding signals to the script's process
+// group. It returns the exit code apd should exit with.
+func runModuleAction(id string, superkey *string, jsonLines bool) (int, error) {
+	var script string
+	err := withModulesLock(false, func() (err error) {
+		script, err = checkModuleAction(id)
+		return err
+	})
+	if err != nil {
+		return 1, err
+	}
+
+	env := moduleScriptEnv(scriptEnv("action", superkey), filepath.Join(moduleDir, id))
+	cmd := scriptCommand(script, env)
+	output := &actionOutput{jsonLines: jsonLines, encoder: json.NewEncoder(os.Stdout)}
+	stdout := &actionStream{emit: output.write, stream: "stdout"}
+	stderr := &actionStream{emit: output.write, stream: "stderr"}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = actionWaitDelay
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	Info("run action of %s", id)
+	if err := cmd.Start(); err != nil {
+		return 1, fmt.Errorf("failed to exec %s: %w", script, err)
+	}
+	switchCgroups(cmd.Process.Pid)
+
+	go func() {
+		for sig := range signals {
+			unix.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+		}
+	}()
+
+	code := 0
+	err = cmd.Wait()
+	stdout.flush()
+	stderr.flush()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		Warn("action of %s left its output open, stopped reading it", id)
+		err = nil
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 1, err
+		}
+		code = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+	}
+	Info("action of %s exited with %d", id, code)
+	output.exit(code)
+	return code, nil
+}
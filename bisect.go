@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// bisectState is persisted in bisectFile across reboots.
+// Each trial enables the modules already known to be good plus the first
+// half of the remaining candidates, and disables everything else.
+type bisectState struct {
+	Original   []string `json:"original"`
+	Candidates []string `json:"candidates"`
+	Good       []string `json:"good"`
+	Trial      []string `json:"trial"`
+	Pending    bool     `json:"pending"`
+	Manual     bool     `json:"manual"`
+	Steps      int      `json:"steps"`
+	Done       bool     `json:"done"`
+	Culprit    string   `json:"culprit,omitempty"`
+}
+
+func readBisect() (*bisectState, error) {
+	data, err := os.ReadFile(bisectFile)
+	if err != nil {
+		return nil, err
+	}
+	state := &bisectState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", bisectFile, err)
+	}
+	return state, nil
+}
+
+func writeBisect(state *bisectState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bisectFile, data, 0600)
+}
+
+func bisectActive() bool {
+	state, err := readBisect()
+	return err == nil && !state.Done
+}
+
+func bisectStart(manual bool) error {
+	if state, err := readBisect(); err == nil && !state.Done {
+		return errors.New("bisect already in progress, run `apd module bisect reset` first")
+	}
+
+	enabled, err := enabledModuleIds()
+	if err != nil {
+		return err
+	}
+	if len(enabled) == 0 {
+		return errors.New("no enabled modules to bisect")
+	}
+
+	state := &bisectState{
+		Original:   enabled,
+		Candidates: enabled,
+		Manual:     manual,
+	}
+	if err := writeBisect(state); err != nil {
+		return err
+	}
+	fmt.Printf("Bisecting %d modules, reboot to start the first trial.\n", len(enabled))
+	return nil
+}
+
+func bisectVerdict(good bool) error {
+	state, err := readBisect()
+	if os.IsNotExist(err) {
+		return errors.New("no bisect in progress")
+	} else if err != nil {
+		return err
+	}
+	if state.Done {
+		return errors.New("bisect already finished")
+	}
+	if !state.Pending {
+		return errors.New("no trial is running, reboot first")
+	}
+
+	state.applyVerdict(good)
+	if state.Done {
+		if err := bisectFinish(state); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%d candidates left, reboot for the next trial.\n", len(state.Candidates))
+	}
+	return writeBisect(state)
+}
+
+func (s *bisectState) applyVerdict(good bool) {
+	if good {
+		s.Good = append(s.Good, s.Trial...)
+		var remaining []string
+		for _, id := range s.Candidates {
+			if !contains(s.Trial, id) {
+				remaining = append(remaining, id)
+			}
+		}
+		s.Candidates = remaining
+	} else {
+		s.Candidates = s.Trial
+	}
+	s.Trial = nil
+	s.Pending = false
+	s.Steps++
+
+	if len(s.Candidates) == 1 {
+		s.Culprit = s.Candidates[0]
+		s.Done = true
+	} else if len(s.Candidates) == 0 {
+		s.Done = true
+	}
+}
+
+// bisectFinish restores the enabled set recorded by bisectStart.
+func bisectFinish(state *bisectState) error {
+	if err := disableAllModulesUpdate(); err != nil {
+		return err
+	}
+	for _, id := range state.Original {
+		if err := enableModule(id, true); err != nil {
+			Error("bisect: failed to re-enable %s: %v", id, err)
+		}
+	}
+
+	if state.Culprit != "" {
+		Info("bisect finished after %d steps, culprit: %s", state.Steps, state.Culprit)
+		fmt.Printf("Bisect finished, culprit: %s\n", state.Culprit)
+	} else {
+		Info("bisect finished after %d steps, no culprit found", state.Steps)
+		fmt.Println("Bisect finished, no culprit found.")
+	}
+	return nil
+}
+
+func bisectReset() error {
+	state, err := readBisect()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !state.Done {
+		if err := bisectFinish(state); err != nil {
+			return err
+		}
+	}
+	return os.Remove(bisectFile)
+}
+
+func bisectStatus() (*bisectState, error) {
+	state, err := readBisect()
+	if os.IsNotExist(err) {
+		return nil, errors.New("no bisect in progress")
+	}
+	return state, err
+}
+
+// bisectPostFsData applies the next trial. A trial still pending at this
+// point never reached boot-completed, which counts as bad unless the
+// user asked to give verdicts manually.
+func bisectPostFsData() error {
+	state, err := readBisect()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if state.Done {
+		return nil
+	}
+
+	if state.Pending && !state.Manual {
+		Warn("bisect: trial %v did not reach boot-completed", state.Trial)
+		state.applyVerdict(false)
+		if state.Done {
+			if err := bisectFinish(state); err != nil {
+				return err
+			}
+			return writeBisect(state)
+		}
+	}
+
+	if !state.Pending {
+		half := (len(state.Candidates) + 1) / 2
+		state.Trial = append([]string{}, state.Candidates[:half]...)
+		state.Pending = true
+	}
+
+	if err := disableAllModulesUpdate(); err != nil {
+		return err
+	}
+	for _, id := range append(append([]string{}, state.Good...), state.Trial...) {
+		if err := enableModule(id, true); err != nil {
+			Error("bisect: failed to enable %s: %v", id, err)
+		}
+	}
+	Info("bisect: step %d, testing %v", state.Steps+1, state.Trial)
+
+	return writeBisect(state)
+}
+
+func bisectBootCompleted() error {
+	state, err := readBisect()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if state.Done || !state.Pending || state.Manual {
+		return nil
+	}
+
+	Info("bisect: trial %v reached boot-completed", state.Trial)
+	state.applyVerdict(true)
+	if state.Done {
+		if err := bisectFinish(state); err != nil {
+			return err
+		}
+	}
+	return writeBisect(state)
+}
+
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
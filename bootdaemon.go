@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	bootDaemonPoll           = 500 * time.Millisecond
+	bootDaemonServiceTimeout = 5 * time.Minute
+)
+
+// bootDaemon is the single init hook alternative to calling post-fs-data,
+// services and boot-completed separately. post-fs-data runs synchronously
+// since init must wait for it, the later stages are driven by a detached
+// child watching the boot properties.
+func bootDaemon(superkey string) error {
+	on_post_fs_data(superkey)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "-s", superkey, "boot-daemon", "--wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start boot daemon: %w", err)
+	}
+	Info("boot daemon running as pid %d", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+func bootDaemonWait(superkey string) {
+	Info("boot daemon: waiting for late_start services")
+	if !waitForProps(map[string]string{
+		"init.svc.zygote":    "running",
+		"init.svc.bootanim":  "running",
+		"sys.boot_completed": "1",
+	}, bootDaemonServiceTimeout) {
+		Warn("boot daemon: no service trigger after %s, starting services anyway", bootDaemonServiceTimeout)
+	}
+	on_services(superkey)
+
+	Info("boot daemon: waiting for sys.boot_completed")
+	waitForProps(map[string]string{"sys.boot_completed": "1"}, 0)
+	on_boot_completed(superkey)
+}
+
+// waitForProps polls until any of the given properties has the wanted
+// value. A zero timeout waits forever.
+func waitForProps(wanted map[string]string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		for name, value := range wanted {
+			if current, err := getprop(name); err == nil && current == value {
+				Info("boot daemon: %s=%s", name, value)
+				return true
+			}
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(bootDaemonPoll)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bootGuardState is persisted in bootGuardFile across reboots.
+// Count is the number of boots that reached post-fs-data without
+// reaching boot-completed, Changed holds the ids of modules installed
+// or updated since the last successful boot.
+type bootGuardState struct {
+	Count    int               `json:"count"`
+	Changed  []string          `json:"changed"`
+	Disabled []bootGuardRecord `json:"disabled,omitempty"`
+}
+
+type bootGuardRecord struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+	Time   int64  `json:"time"`
+}
+
+func readBootGuard() (*bootGuardState, error) {
+	state := &bootGuardState{}
+
+	data, err := os.ReadFile(bootGuardFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		Warn("corrupted %s, resetting: %v", bootGuardFile, err)
+		return &bootGuardState{}, nil
+	}
+	return state, nil
+}
+
+func writeBootGuard(state *bootGuardState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bootGuardFile, data, 0600)
+}
+
+func (s *bootGuardState) addChanged(id string) {
+	if !contains(s.Changed, id) {
+		s.Changed = append(s.Changed, id)
+	}
+}
+
+// bootGuardPostFsData must run before pruneModules so the update flags
+// of freshly installed modules are still visible. It stays out of the
+// way while a bisect is running, which manages the enabled set itself.
+func bootGuardPostFsData() error {
+	if bisectActive() {
+		return nil
+	}
+
+	state, err := readBootGuard()
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(moduleDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if fileExists(filepath.Join(moduleDir, entry.Name(), updateFileName)) {
+			state.addChanged(entry.Name())
+		}
+	}
+
+	if state.Count >= bootGuardThreshold {
+		reason := fmt.Sprintf("bootloop protection: %d consecutive boots did not complete after install or update", state.Count)
+		Warn("%s, disabling %d module(s)", reason, len(state.Changed))
+
+		for _, id := range state.Changed {
+			if !fileExists(filepath.Join(moduleDir, id)) {
+				continue
+			}
+			if err := enableModule(id, false); err != nil {
+				Error("failed to disable module %s: %v", id, err)
+				continue
+			}
+			Warn("module %s disabled by bootloop protection", id)
+			state.Disabled = append(state.Disabled, bootGuardRecord{
+				ID:     id,
+				Reason: reason,
+				Time:   time.Now().Unix(),
+			})
+		}
+		if len(state.Disabled) > bootGuardHistory {
+			state.Disabled = state.Disabled[len(state.Disabled)-bootGuardHistory:]
+		}
+
+		state.Count = 0
+		state.Changed = nil
+	}
+
+	state.Count++
+	Info("boot attempt %d since last successful boot", state.Count)
+	return writeBootGuard(state)
+}
+
+func bootGuardBootCompleted() error {
+	state, err := readBootGuard()
+	if err != nil {
+		return err
+	}
+	state.Count = 0
+	state.Changed = nil
+	return writeBootGuard(state)
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 //static
 const (
 	disableFileName      = "disable"
@@ -21,6 +23,64 @@ const (
 	force_overlayfs_file = "/data/adb/.overlayfs_enable"
 	temp_dir_legacy      = "/sbin"
 	temp_dir             = "/debug_ramdisk"
+	runDir               = "/dev/.apd/"
+	parallel_pfd_file    = "/data/adb/.parallel_post_fs_data"
+	bootGuardFile        = "/data/adb/ap/boot_guard.json"
+	bisectFile           = "/data/adb/ap/bisect.json"
+	safeModeMarkerFile   = "/data/adb/ap/safemode"
+	enabledSnapshotFile  = "/data/adb/ap/enabled_modules"
+	modulesLockFile      = "/data/adb/ap/modules.lock"
+	sysctlBackupFile     = "/data/adb/ap/sysctl_backup.json"
+	moduleEventsFile     = "/data/adb/ap/log/module_events.log"
+	trustDir             = "/data/adb/ap/trust/"
+	trustPolicyFile      = "/data/adb/ap/trust/policy"
+	updateCacheFile      = "/data/adb/ap/update_cache.json"
+	updateIgnoreFile     = "/data/adb/ap/update_ignore"
+	updateDownloadDir    = "/data/adb/ap/downloads/"
+	moduleRollbackDir    = "/data/adb/ap/rollback/"
+	moduleOldDir         = "/data/adb/modules_old/"
+	installJournalFile   = "/data/adb/ap/install_journal.json"
+	installZipDir        = "/data/adb/ap/install/"
+)
+
+// module update checks
+const (
+	updateFetchTimeout = 15 * time.Second
+	updateCacheTTL     = 6 * time.Hour
+	// a failed check is retried soon, the server may only have been down
+	updateErrorCacheTTL = 5 * time.Minute
+	// whole zip download, not just the connection
+	updateDownloadTimeout = 10 * time.Minute
+	updateDownloadMaxSize = 512 << 20
+)
+
+// module event log is rotated once it is larger than this
+const moduleEventsMaxSize = 256 * 1024
+
+// bootloop protection
+const (
+	// consecutive boots that never reach boot-completed before
+	// recently installed or updated modules are disabled
+	bootGuardThreshold = 3
+	bootGuardHistory   = 20
+)
+
+// module directory lock
+const (
+	modulesLockTimeout = 10 * time.Second
+)
+
+// boot stages
+const (
+	stageRunningTimeout = 2 * time.Minute
+)
+
+// stage scripts
+const (
+	maxParallelScripts = 4
+	// a script still running after this gives up its slot to the next
+	// one, e.g. a service that never exits
+	scriptSlotTimeout = 30 * time.Second
 )
 
 // restorecon Constants
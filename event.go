@@ -14,6 +14,11 @@ func execCommand(command string, args []string) error {
 func on_post_fs_data(superkey string) {
 	Umask(0)
 
+	if !enterStage("post-fs-data") {
+		return
+	}
+	defer endStage("post-fs-data")
+
 	InitLoadPackageUidConfig(superkey)
 	InitLoadSuPath(superkey)
 
@@ -33,7 +38,7 @@ func on_post_fs_data(superkey string) {
 	// Create log environment
 	if _, err := os.Stat(ap_log); os.IsNotExist(err) {
 		if err := os.Mkdir(ap_log, 0700); err != nil {
-			Error("failed to create log folder: %w", err)
+			Error("failed to create log folder: %v", err)
 		}
 	}
 
@@ -57,31 +62,15 @@ func on_post_fs_data(superkey string) {
 	if err := cmd.Run(); err != nil {
 		Error("failed to start dmesg: %v\n", err)
 	}
-	safeMode := isSafeMode(&superkey)
-
-	if safeMode {
-		if err := disableAllModulesUpdate(); err != nil {
-			Error("disable all modules failed: %v", err)
-		}
-	} else {
-		if err := execCommonScripts("post-fs-data.d", true); err != nil {
-			//warn(fmt.Sprintf("exec common post-fs-data scripts failed: %v", err))
-			Error("exec common post-fs-data scripts failed: %v", err)
-		}
-	}
+	safeMode := initSafeMode(&superkey)
 
 	moduleUpdateFlag := filepath.Join(workingDir, updateFileName)
 	if err := ensureBinary(binaryDir); err != nil {
-		Error("binary missing: %w", err)
+		Error("binary missing: %v", err)
 		return
 	}
-	if _, err := os.Stat(moduleupdateDir); err == nil {
-		if err := moveFile(moduleupdateDir, moduleDir); err != nil {
-
-		}
-		if err := os.RemoveAll(moduleupdateDir); err != nil {
-
-		}
+	if err := runStep("update modules", func() error { return updateModules(safeMode) }); err != nil {
+		Error("update modules failed: %v", err)
 	}
 	tmpModuleImg := tmp_img
 	tmpModulePath := filepath.Join(tmpModuleImg)
@@ -94,40 +83,53 @@ func on_post_fs_data(superkey string) {
 	}
 
 	if safeMode {
-		//warn("safe mode, skip post-fs-data scripts and disable all modules!")
-		if err := disableAllModulesUpdate(); err != nil {
-			//warn(fmt.Sprintf("disable all modules failed: %v", err))
-			Error("disable all modules failed: %v", err)
-		}
+		// modules are only skipped for this boot, their disable flags stay untouched
+		Warn("safe mode, skip post-fs-data scripts and all modules!")
 		return
 	}
 
-	if err := pruneModules(); err != nil {
-		Error("prune modules failed: %v", err)
+	// modules are read from here on, hold them shared so nothing is
+	// installed or removed underneath the mounts and scripts
+	lock := lockModulesForBoot()
+	if err := runStep("restorecon", RestoreCon); err != nil {
+		Error("restorecon failed: %v", err)
 	}
 
-	if err := RestoreCon(); err != nil {
-		Error("restorecon failed: %v", err)
+	if err := runStep("sepolicy.rule", loadSEPolicyRule); err != nil {
+		Error("load sepolicy.rule failed: %v", err)
 	}
 
-	if err := loadSEPolicyRule(); err != nil {
-		Error("load sepolicy.rule failed")
+	if err := runStep("kernel modules", loadKernelModules); err != nil {
+		Error("load kernel modules failed: %v", err)
 	}
 
-	if err := mountTmpfs(getTmpPath()); err != nil {
+	if err := runStep("tmp path", func() error { _, err := setupTmpPath(); return err }); err != nil {
 		Error("do temp dir mount failed: %v", err)
 	}
 
-	// Execute modules post-fs-data scripts
-	if err := ExecStageScript("post-fs-data", true); err != nil {
+	// Execute common and modules post-fs-data scripts
+	if err := runStep("post-fs-data scripts", func() error {
+		return runStageScripts("post-fs-data", &superkey, true)
+	}); err != nil {
 		Error("exec post-fs-data scripts failed: %v", err)
 	}
 
 	// Load system.prop
-	if err := loadSystemProp(); err != nil {
+	if err := runStep("system.prop", loadSystemProp); err != nil {
 		Error("load system.prop failed: %v", err)
 	}
-	//magicMount()
+
+	if err := runStep("sysctl.conf", func() error { return applySysctl("post-fs-data") }); err != nil {
+		Error("apply sysctl.conf failed: %v", err)
+	}
+
+	// magic mount was disabled here before deferred mounts existed; it
+	// now runs on every boot. Modules that deferred their mounts are
+	// left to service and boot-completed.
+	if err := runStep("magic mount", magicMount); err != nil {
+		Error("magic mount failed: %v", err)
+	}
+	lock.Unlock()
 	//if shouldEnableOverlay() {
 	//	if err := mountSystemlessly(moduleDir); err != nil {
 	//		warn(fmt.Sprintf("do systemless mount failed: %v", err))
@@ -138,20 +140,47 @@ func on_post_fs_data(superkey string) {
 	//	}
 	//}
 
-	runStage("post-mount", &superkey, true)
+	if enterStage("post-mount") {
+		runStep("post-mount", func() error {
+			runStage("post-mount", &superkey, true)
+			return nil
+		})
+		endStage("post-mount")
+	}
 
 	if err := os.Chdir("/"); err != nil {
-		Error("failed to chdir to /: %w", err)
+		Error("failed to chdir to /: %v", err)
 	}
 
 	return
 }
 func on_services(superkey string) {
 	Info("on_services triggered!")
+	if !enterStage("service") {
+		return
+	}
+	defer endStage("service")
 	runStage("service", &superkey, false)
 }
 func on_boot_completed(superkey string) {
 	Info("on_boot_completed triggered!")
+	if !enterStage("boot-completed") {
+		return
+	}
+	defer endStage("boot-completed")
+	if isSafeMode(&superkey) {
+		clearSafeModeMarker()
+	} else {
+		if err := runStep("bootloop protection", bootGuardBootCompleted); err != nil {
+			Error("failed to reset boot counter: %v", err)
+		}
+		if err := runStep("bisect", func() error { return withModulesLock(true, bisectBootCompleted) }); err != nil {
+			Error("bisect failed: %v", err)
+		}
+		if err := runStep("property hooks", func() error { return spawnPropHookWatcher(&superkey) }); err != nil {
+			Error("property hooks failed: %v", err)
+		}
+	}
 	runStage("boot-completed", &superkey, false)
 }
 func runStage(stage string, superkey *string, block bool) {
@@ -164,48 +193,61 @@ func runStage(stage string, superkey *string, block bool) {
 
 	if isSafeMode(superkey) {
 		Info("safe mode, skip %s scripts", stage)
-		if err := disableAllModulesUpdate(); err != nil {
-			Error("disable all modules failed: %v", err)
-		}
 		return
 	}
 
-	if err := execScript(fmt.Sprintf("%s.d", stage), block); err != nil {
-		Error("Failed to exec common %s scripts: %v", stage, err)
+	lock := lockModulesForBoot()
+	defer lock.Unlock()
+
+	if err := runStep(stage+" sysctl.conf", func() error { return applySysctl(stage) }); err != nil {
+		Error("apply %s sysctl.conf failed: %v", stage, err)
+	}
+	if stage == "service" || stage == "boot-completed" {
+		if err := runStep(stage+" late mount", func() error {
+			return magicMountStage(stage)
+		}); err != nil {
+			Error("late mount at %s failed: %v", stage, err)
+		}
 	}
-	if err := ExecStageScript(stage, block); err != nil {
+	if err := runStep(stage+" scripts", func() error {
+		return runStageScripts(stage, superkey, block)
+	}); err != nil {
 		Error("Failed to exec %s scripts: %v", stage, err)
 	}
 }
 
-func moveFile(moduleUpdateDir, moduleDir string) error {
-	entries, err := os.ReadDir(moduleUpdateDir)
+// updateModules activates staged updates and handles pending removals
+// while holding the module lock.
+func updateModules(safeMode bool) error {
+	lock, err := lockModules(true)
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
 
-	for _, entry := range entries {
-		fileName := entry.Name()
-		sourcePath := filepath.Join(moduleUpdateDir, fileName)
-		targetPath := filepath.Join(moduleDir, fileName)
-
-		if entry.IsDir() {
-			updateFilePath := filepath.Join(targetPath, updateFileName)
-			if _, err := os.Stat(updateFilePath); err == nil {
-				if _, err := os.Stat(targetPath); err == nil {
-					Info("Removing existing folder in target directory: %s\n", fileName)
-					if err := os.RemoveAll(targetPath); err != nil {
-						return err
-					}
-				}
-
-				Info("Moving %s to target directory\n", fileName)
-				if err := os.Rename(sourcePath, targetPath); err != nil {
-					return err
-				}
-			}
+	if _, err := os.Stat(moduleupdateDir); err == nil {
+		if err := activateStagedModules(); err != nil {
+			Error("failed to activate staged modules: %v", err)
+		}
+		if err := os.RemoveAll(moduleupdateDir); err != nil {
+			Error("failed to clean %s: %v", moduleupdateDir, err)
 		}
 	}
 
+	if safeMode {
+		return nil
+	}
+
+	if err := runStep("bootloop protection", bootGuardPostFsData); err != nil {
+		Error("bootloop protection failed: %v", err)
+	}
+
+	if err := runStep("bisect", bisectPostFsData); err != nil {
+		Error("bisect failed: %v", err)
+	}
+
+	if err := runStep("prune modules", pruneModules); err != nil {
+		Error("prune modules failed: %v", err)
+	}
 	return nil
 }
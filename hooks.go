@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	modulePropHooks = "prop_hooks"
+	// the watcher polls every propHookInterval after a change and backs
+	// off to propHookMaxInterval while nothing changes, so a hook fires
+	// at most a few seconds late
+	propHookInterval    = time.Second
+	propHookMaxInterval = 3 * time.Second
+	// hook scripts running at once, the watcher waits for a free slot
+	propHookMaxRunning = 4
+)
+
+var getpropLinePattern = regexp.MustCompile(`^\[(.*)\]: \[(.*)\]$`)
+
+// propHook is one line of a module's prop_hooks file:
+//
+//	on property:sys.usb.config=mtp usb_mtp.sh
+//
+// "*" as value matches any change of the property.
+type propHook struct {
+	module string
+	name   string
+	value  string
+	script string
+}
+
+func (h propHook) matches(value string) bool {
+	return h.value == "*" || h.value == value
+}
+
+func parsePropHooks(module string) ([]propHook, error) {
+	file, err := os.Open(filepath.Join(module, modulePropHooks))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hooks []propHook
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "on" || !strings.HasPrefix(fields[1], "property:") {
+			return nil, fmt.Errorf("line %d: expected \"on property:<name>=<value> <script>\"", lineNo)
+		}
+		trigger := strings.SplitN(strings.TrimPrefix(fields[1], "property:"), "=", 2)
+		if len(trigger) != 2 || trigger[0] == "" {
+			return nil, fmt.Errorf("line %d: invalid trigger %s", lineNo, fields[1])
+		}
+		script := filepath.Join(module, fields[2])
+		if !strings.HasPrefix(script, filepath.Clean(module)+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("line %d: script %s is outside the module", lineNo, fields[2])
+		}
+		hooks = append(hooks, propHook{
+			module: module,
+			name:   trigger[0],
+			value:  trigger[1],
+			script: script,
+		})
+	}
+	return hooks, scanner.Err()
+}
+
+func collectPropHooks() ([]propHook, error) {
+	var hooks []propHook
+	err := foreachModuleStep("property hooks", true, func(module string) error {
+		if !fileExists(filepath.Join(module, modulePropHooks)) {
+			return nil
+		}
+		moduleHooks, err := parsePropHooks(module)
+		if err != nil {
+			Error("module %s: invalid %s: %v", filepath.Base(module), modulePropHooks, err)
+			return nil
+		}
+		hooks = append(hooks, moduleHooks...)
+		return nil
+	})
+	return hooks, err
+}
+
+// getprops returns every system property in one getprop call.
+func getprops() (map[string]string, error) {
+	output, err := exec.Command("getprop").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running getprop: %w", err)
+	}
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if match := getpropLinePattern.FindStringSubmatch(line); match != nil {
+			props[match[1]] = match[2]
+		}
+	}
+	return props, nil
+}
+
+func runPropHook(hook propHook, value string, env []string, slots chan struct{}) {
+	if fileExists(filepath.Join(hook.module, disableFileName)) {
+		return
+	}
+	Info("property %s=%s triggers %s", hook.name, value, hook.script)
+
+	env = moduleScriptEnv(env, hook.module)
+	env = append(env, fmt.Sprintf("PROP_NAME=%s", hook.name))
+	env = append(env, fmt.Sprintf("PROP_VALUE=%s", value))
+
+	script := stageScript{module: filepath.Base(hook.module), path: hook.script, env: env}
+	slots <- struct{}{}
+	go func() {
+		defer func() { <-slots }()
+		if err := runTrackedScript("prop-hook", script); err != nil {
+			Error("property hook failed: %v", err)
+		}
+	}()
+}
+
+// watchPropHooks polls the property area and runs the hooks whose trigger
+// matches a property as it changes, with at most propHookMaxRunning hook
+// scripts at a time. Hooks already matching when the
+// watcher starts run once, like init property triggers at boot.
+func watchPropHooks(superkey *string) error {
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(runDir, "prop_hooks.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return fmt.Errorf("property hook watcher already running")
+	}
+
+	hooks, err := collectPropHooks()
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		Info("no property hooks declared")
+		return nil
+	}
+	env := scriptEnv("prop-hook", superkey)
+
+	slots := make(chan struct{}, propHookMaxRunning)
+	last := map[string]string{}
+	first := true
+	interval := propHookInterval
+	for {
+		changed := false
+		props, err := getprops()
+		if err != nil {
+			Error("%v", err)
+		} else {
+			for _, hook := range hooks {
+				value, ok := props[hook.name]
+				if !ok {
+					continue
+				}
+				previous, seen := last[hook.name]
+				if first || !seen || previous != value {
+					if !first {
+						changed = true
+					}
+					if hook.matches(value) {
+						runPropHook(hook, value, env, slots)
+					}
+				}
+			}
+			for _, hook := range hooks {
+				last[hook.name] = props[hook.name]
+			}
+			first = false
+		}
+
+		if changed {
+			interval = propHookInterval
+		} else {
+			interval *= 2
+			if interval > propHookMaxInterval {
+				interval = propHookMaxInterval
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func spawnPropHookWatcher(superkey *string) error {
+	hooks, err := collectPropHooks()
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	key := "none"
+	if superkey != nil {
+		key = *superkey
+	}
+	cmd := exec.Command(exe, "-s", key, "hooks", "watch")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start property hook watcher: %w", err)
+	}
+	Info("property hooks watched by pid %d", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
@@ -348,15 +348,18 @@ install_module() {
   rm -rf $MODPATH
   mkdir -p $MODPATH
 
+  # fd 3 holds the modules lock for `apd module state` below. Module code
+  # runs with it closed, anything it leaves running in the background
+  # would otherwise keep the lock held.
   if is_legacy_script; then
     unzip -oj "$ZIPFILE" module.prop install.sh uninstall.sh 'common/*' -d $TMPDIR >&2
 
     # Load install script
-    . $TMPDIR/install.sh
+    . $TMPDIR/install.sh 3>&-
 
     # Callbacks
-    print_modname
-    on_install
+    print_modname 3>&-
+    on_install 3>&-
 
     [ -f $TMPDIR/uninstall.sh ] && cp -af $TMPDIR/uninstall.sh $MODPATH/uninstall.sh
     $SKIPMOUNT && touch $MODPATH/skip_mount
@@ -366,7 +369,7 @@ install_module() {
     $LATESTARTSERVICE && cp -af $TMPDIR/service.sh $MODPATH/service.sh
 
     ui_print "- Setting permissions"
-    set_permissions
+    set_permissions 3>&-
   else
     print_title "$MODNAME" "by $MODAUTH"
     print_title "Powered by APatch"
@@ -386,7 +389,7 @@ install_module() {
     fi
 
     # Load customization script
-    [ -f $MODPATH/customize.sh ] && . $MODPATH/customize.sh
+    [ -f $MODPATH/customize.sh ] && . $MODPATH/customize.sh 3>&-
   fi
 
   handle_partition vendor true
@@ -407,9 +410,8 @@ install_module() {
   done
 
   if $BOOTMODE; then
-    mktouch $NVBASE/modules/$MODID/update
-    rm -rf $NVBASE/modules/$MODID/remove 2>/dev/null
-    rm -rf $NVBASE/modules/$MODID/disable 2>/dev/null
+    # marks the module for update, keeps it disabled if it was
+    /data/adb/apd module state $MODID update || abort "! Unable to mark $MODID for update"
     cp -af $MODPATH/module.prop $NVBASE/modules/$MODID/module.prop
   fi
 
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Installs are staged in modules_update/<id> and only replace the live
+// module at the next post-fs-data. The install journal follows every
+// staged module through these states, so an install interrupted half way
+// is never activated and an activation interrupted by a reboot is rolled
+// back to the previous copy.
+const (
+	journalStaging    = "staging"
+	journalStaged     = "staged"
+	journalFailed     = "failed"
+	journalActivating = "activating"
+	journalActivated  = "activated"
+	journalRolledBack = "rolled-back"
+)
+
+type journalEntry struct {
+	ID          string    `json:"id"`
+	Zip         string    `json:"zip,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	VersionCode int64     `json:"versionCode,omitempty"`
+	Status      string    `json:"status"`
+	Updated     time.Time `json:"updated"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type pendingModule struct {
+	ID          string    `json:"id"`
+	Version     string    `json:"version"`
+	VersionCode int64     `json:"versionCode"`
+	Status      string    `json:"status"`
+	Zip         string    `json:"zip,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+func readInstallJournal() map[string]*journalEntry {
+	journal := map[string]*journalEntry{}
+	if data, err := os.ReadFile(installJournalFile); err == nil {
+		json.Unmarshal(data, &journal)
+	}
+	return journal
+}
+
+func writeInstallJournal(journal map[string]*journalEntry) error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(installJournalFile, data, 0600)
+}
+
+// journalModule records a new status for a module. The journal is written
+// before the step it describes is carried out.
+func journalModule(id, status string, update func(entry *journalEntry)) error {
+	journal := readInstallJournal()
+	entry, ok := journal[id]
+	if !ok {
+		entry = &journalEntry{ID: id}
+		journal[id] = entry
+	}
+	entry.Status = status
+	entry.Updated = time.Now()
+	entry.Error = ""
+	if update != nil {
+		update(entry)
+	}
+	return writeInstallJournal(journal)
+}
+
+// pruneInstallJournal drops the entries that are done with, those that
+// were activated and those whose staged copy is gone.
+func pruneInstallJournal() {
+	journal := readInstallJournal()
+	pruned := false
+	for id, entry := range journal {
+		if entry.Status == journalActivating {
+			continue
+		}
+		if entry.Status == journalActivated || !fileExists(filepath.Join(moduleupdateDir, id)) {
+			delete(journal, id)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return
+	}
+	if err := writeInstallJournal(journal); err != nil {
+		Error("failed to write install journal: %v", err)
+	}
+}
+
+func journalFailure(id string, err error) {
+	if jerr := journalModule(id, journalFailed, func(entry *journalEntry) {
+		entry.Error = err.Error()
+	}); jerr != nil {
+		Error("failed to write install journal: %v", jerr)
+	}
+}
+
+// abortInstall drops what a failed installer left in the staging area.
+// before is the module's state from before the installer ran, the update
+// flag is only cleared when this install set it.
+func abortInstall(id string, before moduleState, cause error) {
+	Error("install of %s failed: %v", id, cause)
+	if err := os.RemoveAll(filepath.Join(moduleupdateDir, id)); err != nil {
+		Error("failed to remove staged %s: %v", id, err)
+	}
+	if !before.Installed {
+		// only the flags of the new module are there yet
+		if err := os.RemoveAll(filepath.Join(moduleDir, id)); err != nil {
+			Error("failed to remove %s: %v", id, err)
+		}
+	} else if !before.Update && readModuleState(id).Update {
+		if err := transitionModule(id, transitionUpdated); err != nil {
+			Error("%v", err)
+		}
+	}
+	journalFailure(id, cause)
+}
+
+// recoverActivations finishes or rolls back activations a reboot cut
+// short. The live copy was moved aside first, so a missing live module
+// means the new copy never made it.
+func recoverActivations() {
+	for id, entry := range readInstallJournal() {
+		if entry.Status != journalActivating {
+			continue
+		}
+		live := filepath.Join(moduleDir, id)
+		old := filepath.Join(moduleOldDir, id)
+		if fileExists(live) {
+			// the flags were written before the swap, but the old copy
+			// may have been disabled or marked for removal since
+			if fileExists(old) {
+				if err := carryModuleFlags(old, live); err != nil {
+					Error("%v", err)
+				}
+				if err := os.RemoveAll(old); err != nil {
+					Error("failed to remove %s: %v", old, err)
+				}
+			}
+			if err := journalModule(id, journalActivated, nil); err != nil {
+				Error("failed to write install journal: %v", err)
+			}
+			continue
+		}
+		if !fileExists(old) {
+			journalFailure(id, fmt.Errorf("activation interrupted, no copy left"))
+			continue
+		}
+		if err := os.Rename(old, live); err != nil {
+			Error("failed to roll back %s: %v", id, err)
+			continue
+		}
+		Warn("activation of %s was interrupted, rolled back", id)
+		if err := journalModule(id, journalRolledBack, nil); err != nil {
+			Error("failed to write install journal: %v", err)
+		}
+	}
+}
+
+// carryModuleFlags copies the user set flags of one copy of a module to
+// another, the flags are never taken away.
+func carryModuleFlags(from, to string) error {
+	for _, name := range []string{disableFileName, removeFileName} {
+		if !fileExists(filepath.Join(from, name)) {
+			continue
+		}
+		if err := setModuleFlag(to, name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activateModule swaps the staged copy of a module in with two renames
+// and puts the previous copy back when the second one fails.
+func activateModule(id string) error {
+	live := filepath.Join(moduleDir, id)
+	staged := filepath.Join(moduleupdateDir, id)
+	old := filepath.Join(moduleOldDir, id)
+	state := readModuleState(id)
+
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(moduleOldDir, 0700); err != nil {
+		return err
+	}
+
+	// the staged copy has no flags, carry over disable and remove, and
+	// set update so the boot steps that follow see the module as just
+	// updated. They are written before the swap so the new copy never
+	// shows up live without them.
+	if err := setModuleFlag(staged, updateFileName, true); err != nil {
+		return err
+	}
+	if state.Installed {
+		if err := carryModuleFlags(live, staged); err != nil {
+			return err
+		}
+	}
+	if err := journalModule(id, journalActivating, nil); err != nil {
+		return err
+	}
+
+	if state.Installed {
+		if err := os.Rename(live, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", live, err)
+		}
+	}
+	if err := os.Rename(staged, live); err != nil {
+		if state.Installed {
+			if rerr := os.Rename(old, live); rerr != nil {
+				Error("failed to roll back %s: %v", id, rerr)
+			}
+		}
+		return fmt.Errorf("failed to activate %s: %w", id, err)
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		Warn("failed to remove %s: %v", old, err)
+	}
+	Info("activated %s", id)
+	return journalModule(id, journalActivated, nil)
+}
+
+// activateStagedModules activates every fully staged module, modules
+// whose installer did not finish are dropped.
+func activateStagedModules() error {
+	recoverActivations()
+
+	entries, err := os.ReadDir(moduleupdateDir)
+	if err != nil {
+		return err
+	}
+	journal := readInstallJournal()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+		if record, ok := journal[id]; ok && record.Status == journalStaging {
+			Warn("install of %s did not finish, dropping it", id)
+			journalFailure(id, fmt.Errorf("installer did not finish"))
+			continue
+		}
+		if !readModuleState(id).Update {
+			continue
+		}
+		if err := activateModule(id); err != nil {
+			Error("%v", err)
+			journalFailure(id, err)
+		}
+	}
+	pruneInstallJournal()
+	return nil
+}
+
+func listPendingModules() ([]pendingModule, error) {
+	pending := []pendingModule{}
+	entries, err := os.ReadDir(moduleupdateDir)
+	if os.IsNotExist(err) {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	journal := readInstallJournal()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		module := pendingModule{ID: entry.Name(), Status: journalStaged}
+		if prop, err := loadModuleProp(filepath.Join(moduleupdateDir, entry.Name())); err == nil {
+			module.Version = prop.Version
+			module.VersionCode = prop.VersionCode
+		}
+		if record, ok := journal[entry.Name()]; ok {
+			module.Status = record.Status
+			module.Zip = record.Zip
+			module.Updated = record.Updated
+		}
+		pending = append(pending, module)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	return pending, nil
+}
+
+func printPendingModules(pending []pendingModule) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tVERSION\tSTATUS\tSTAGED\tZIP")
+	for _, p := range pending {
+		staged, zip := "-", "-"
+		if !p.Updated.IsZero() {
+			staged = p.Updated.Format("2006-01-02 15:04:05")
+		}
+		if p.Zip != "" {
+			zip = p.Zip
+		}
+		fmt.Fprintf(w, "%s\t%s (%d)\t%s\t%s\t%s\n", p.ID, p.Version, p.VersionCode, p.Status, staged, zip)
+	}
+	w.Flush()
+}
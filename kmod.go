@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kernelModulesDir  = "kernel_modules"
+	kernelModuleOrder = "load_order"
+)
+
+// kmodResult describes one .ko shipped by a module and is kept in
+// runDir/kmod/<id>.json for the module status.
+type kmodResult struct {
+	Name             string `json:"name"`
+	Params           string `json:"params,omitempty"`
+	Loaded           bool   `json:"loaded"`
+	AlreadyLoaded    bool   `json:"already_loaded,omitempty"`
+	Vermagic         string `json:"vermagic,omitempty"`
+	VermagicMismatch bool   `json:"vermagic_mismatch,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+type kmodEntry struct {
+	name   string
+	params string
+}
+
+func kmodStatusFile(id string) string {
+	return filepath.Join(runDir, "kmod", id+".json")
+}
+
+// kmodLoadOrder reads kernel_modules/load_order, one "file.ko [params]" per
+// line. Without it every .ko is loaded in filename order.
+func kmodLoadOrder(dir string) ([]kmodEntry, error) {
+	var entries []kmodEntry
+
+	file, err := os.Open(filepath.Join(dir, kernelModuleOrder))
+	if os.IsNotExist(err) {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.ko"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			entries = append(entries, kmodEntry{name: filepath.Base(match)})
+		}
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		entry := kmodEntry{name: parts[0]}
+		if len(parts) == 2 {
+			entry.params = strings.TrimSpace(parts[1])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// kmodVermagic returns the vermagic string from the .modinfo section.
+func kmodVermagic(path string) (string, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	section := file.Section(".modinfo")
+	if section == nil {
+		return "", fmt.Errorf("%s has no .modinfo section", path)
+	}
+	data, err := section.Data()
+	if err != nil {
+		return "", err
+	}
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if value, ok := strings.CutPrefix(string(field), "vermagic="); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+func loadKernelModule(path, params, release string) kmodResult {
+	result := kmodResult{Name: filepath.Base(path), Params: params}
+
+	if vermagic, err := kmodVermagic(path); err != nil {
+		Warn("failed to read vermagic of %s: %v", path, err)
+	} else if vermagic != "" {
+		result.Vermagic = vermagic
+		if fields := strings.Fields(vermagic); release != "" && len(fields) > 0 && fields[0] != release {
+			result.VermagicMismatch = true
+			Warn("%s built for %s, running %s", path, fields[0], release)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer file.Close()
+
+	err = unix.FinitModule(int(file.Fd()), params, 0)
+	switch err {
+	case nil:
+		result.Loaded = true
+	case unix.EEXIST:
+		result.Loaded = true
+		result.AlreadyLoaded = true
+	default:
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func loadModuleKernelModules(module string, release string) error {
+	dir := filepath.Join(module, kernelModulesDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	id := filepath.Base(module)
+
+	entries, err := kmodLoadOrder(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read load order of %s: %w", id, err)
+	}
+
+	results := []kmodResult{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.name)
+		if filepath.Dir(path) != dir {
+			Warn("module %s: ignoring kernel module outside %s: %s", id, kernelModulesDir, entry.name)
+			continue
+		}
+		result := loadKernelModule(path, entry.params, release)
+		if result.Error != "" {
+			Error("module %s: failed to load %s: %s", id, entry.name, result.Error)
+		} else {
+			Info("module %s: loaded %s", id, entry.name)
+		}
+		results = append(results, result)
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(kmodStatusFile(id)), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(kmodStatusFile(id), data, 0600)
+}
+
+func loadKernelModules() error {
+	release := kernelRelease()
+	return foreachModuleStep("kernel modules", true, func(module string) error {
+		if err := loadModuleKernelModules(module, release); err != nil {
+			Error("%v", err)
+		}
+		return nil
+	})
+}
+
+func readKmodStatus(id string) ([]kmodResult, error) {
+	data, err := os.ReadFile(kmodStatusFile(id))
+	if err != nil {
+		return nil, err
+	}
+	var results []kmodResult
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// modulesLock serializes access to /data/adb/modules between apd
+// processes. Readers take it shared, anything that creates, moves or
+// removes module files takes it exclusive. flock conflicts between two
+// descriptors of the same process too, so it is taken once at the entry
+// points (CLI commands and boot handler steps), never inside helpers.
+type modulesLock struct {
+	file *os.File
+}
+
+// modulesLockFdEnv is set for the installer script. apd commands it runs
+// find the lock already held by their parent on that descriptor and must
+// not try to take it again.
+const modulesLockFdEnv = "APD_MODULES_LOCK_FD"
+
+func lockModules(exclusive bool) (*modulesLock, error) {
+	if err := ensureDirExists(workingDir); err != nil {
+		return nil, err
+	}
+	if inheritedModulesLock() {
+		return &modulesLock{}, nil
+	}
+	file, err := os.OpenFile(modulesLockFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", modulesLockFile, err)
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	deadline := time.Now().Add(modulesLockTimeout)
+	for {
+		err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return &modulesLock{file: file}, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", modulesLockFile, err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("modules are busy: another apd operation still holds %s after %s", modulesLockFile, modulesLockTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// inheritedModulesLock reports whether the parent apd handed its lock
+// down. The variable is read once and unset, so the scripts apd runs do
+// not inherit it, and the descriptor only counts when it is the lock file
+// and the lock really is held exclusively.
+var inheritedModulesLock = sync.OnceValue(func() bool {
+	value, ok := os.LookupEnv(modulesLockFdEnv)
+	if !ok {
+		return false
+	}
+	os.Unsetenv(modulesLockFdEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return false
+	}
+	var held, lockFile unix.Stat_t
+	if unix.Fstat(fd, &held) != nil || unix.Stat(modulesLockFile, &lockFile) != nil {
+		return false
+	}
+	if held.Dev != lockFile.Dev || held.Ino != lockFile.Ino {
+		return false
+	}
+
+	file, err := os.Open(modulesLockFile)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_SH|unix.LOCK_NB); err == nil {
+		unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		Warn("%s=%s but the modules lock is not held, ignoring it", modulesLockFdEnv, value)
+		return false
+	}
+	return true
+})
+
+func (l *modulesLock) Unlock() {
+	if l.file == nil {
+		// held by the parent process
+		return
+	}
+	unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	l.file.Close()
+}
+
+// lockModulesForBoot takes the lock shared for a boot handler. Boot goes
+// on without it rather than skip the modules when it can't be taken.
+func lockModulesForBoot() *modulesLock {
+	lock, err := lockModules(false)
+	if err != nil {
+		Warn("reading modules without the lock: %v", err)
+		return &modulesLock{}
+	}
+	return lock
+}
+
+func withModulesLock(exclusive bool, fn func() error) error {
+	lock, err := lockModules(exclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return fn()
+}
@@ -26,14 +26,57 @@ func printUsage() {
 
 	fmt.Fprintf(os.Stderr, "Commands:\n")
 	fmt.Fprintf(os.Stderr, "  module install <path>      Install a module from the given path.\n")
+	fmt.Fprintf(os.Stderr, "  module verify <zip> [--json]\n")
+	fmt.Fprintf(os.Stderr, "                             Check a module zip, also done before install.\n")
 	fmt.Fprintf(os.Stderr, "  module test <func>         Run a test function.\n")
-	fmt.Fprintf(os.Stderr, "  module list                List all installed modules.\n")
+	fmt.Fprintf(os.Stderr, "  module list [--filter f1,f2] [--sort key] [--schema 1]\n")
+	fmt.Fprintf(os.Stderr, "                             List installed modules as JSON. Filters: enabled,\n")
+	fmt.Fprintf(os.Stderr, "                             disabled, update, remove, web, action. Sort keys:\n")
+	fmt.Fprintf(os.Stderr, "                             id, name, author, versionCode. --schema 1 prints\n")
+	fmt.Fprintf(os.Stderr, "                             the versioned, typed list.\n")
 	fmt.Fprintf(os.Stderr, "  module enable <name>       Enable a specific module.\n")
 	fmt.Fprintf(os.Stderr, "  module disable <name>      Disable a specific module.\n")
+	fmt.Fprintf(os.Stderr, "  module action <id> [--json]\n")
+	fmt.Fprintf(os.Stderr, "                             Run the module's action.sh, --json prints one\n")
+	fmt.Fprintf(os.Stderr, "                             JSON object per output line.\n")
+	fmt.Fprintf(os.Stderr, "  module webui <id> [--port n]\n")
+	fmt.Fprintf(os.Stderr, "                             Serve the module's webroot on 127.0.0.1 and print\n")
+	fmt.Fprintf(os.Stderr, "                             the URL to open.\n")
+	fmt.Fprintf(os.Stderr, "  module check-updates [--json] [--force] [--ignore id] [--unignore id]\n")
+	fmt.Fprintf(os.Stderr, "                             Check the updateJson of enabled modules, results\n")
+	fmt.Fprintf(os.Stderr, "                             are cached for a few hours unless --force.\n")
+	fmt.Fprintf(os.Stderr, "  module update <id>         Download and install the latest version from\n")
+	fmt.Fprintf(os.Stderr, "                             updateJson, keeping the current one.\n")
+	fmt.Fprintf(os.Stderr, "  module rollback <id>       Go back to the version kept by the last update.\n")
+	fmt.Fprintf(os.Stderr, "  module pending [--json]    List installs staged for the next reboot.\n")
+	fmt.Fprintf(os.Stderr, "  module uninstall <id> [--now]\n")
+	fmt.Fprintf(os.Stderr, "                             Remove a module on the next reboot, or right away\n")
+	fmt.Fprintf(os.Stderr, "                             with --now.\n")
+	fmt.Fprintf(os.Stderr, "  module restore <id>        Cancel a pending removal.\n")
 	fmt.Fprintf(os.Stderr, "  module disable_all_modules Disable all modules.\n")
+	fmt.Fprintf(os.Stderr, "  module state <id> [transition]\n")
+	fmt.Fprintf(os.Stderr, "                             Show the module state, after applying one of\n")
+	fmt.Fprintf(os.Stderr, "                             %s.\n", moduleTransitionNames())
+	fmt.Fprintf(os.Stderr, "  module restore-enabled     Re-enable the modules disabled by disable_all_modules.\n")
+	fmt.Fprintf(os.Stderr, "  module bisect start [--manual]\n")
+	fmt.Fprintf(os.Stderr, "                             Find a broken module by enabling half of the\n")
+	fmt.Fprintf(os.Stderr, "                             remaining candidates on each reboot.\n")
+	fmt.Fprintf(os.Stderr, "  module bisect good|bad     Give a verdict for the current trial.\n")
+	fmt.Fprintf(os.Stderr, "  module bisect status       Show bisect progress.\n")
+	fmt.Fprintf(os.Stderr, "  module bisect reset        Abort bisect and restore the enabled modules.\n")
+	fmt.Fprintf(os.Stderr, "  trust add <name> <key>     Trust an ed25519 public key (PEM or base64) for\n")
+	fmt.Fprintf(os.Stderr, "                             module signatures.\n")
+	fmt.Fprintf(os.Stderr, "  trust remove <name>        Remove a trusted key.\n")
+	fmt.Fprintf(os.Stderr, "  trust list                 List trusted keys.\n")
+	fmt.Fprintf(os.Stderr, "  trust policy [off|warn|enforce]\n")
+	fmt.Fprintf(os.Stderr, "                             Show or set how unsigned modules are installed.\n")
+	fmt.Fprintf(os.Stderr, "  status                     Show the daemon status as JSON.\n")
+	fmt.Fprintf(os.Stderr, "  scripts ps [--json]        Show stage scripts started during this boot.\n")
 	fmt.Fprintf(os.Stderr, "  post-fs-data               Trigger the post-fs-data event.\n")
 	fmt.Fprintf(os.Stderr, "  services                   Trigger the services event.\n")
 	fmt.Fprintf(os.Stderr, "  boot-completed             Trigger the boot-completed event.\n")
+	fmt.Fprintf(os.Stderr, "  boot-daemon                Run post-fs-data, then trigger the later events\n")
+	fmt.Fprintf(os.Stderr, "                             from boot properties in the background.\n")
 	fmt.Fprintf(os.Stderr, "  getprop <key>              Get a system property value.\n")
 
 	fmt.Fprintf(os.Stderr, "\nGlobal Options:\n")
@@ -83,7 +126,7 @@ func main() {
 		switch moduleCmd {
 		case "test":
 
-			magicMount()
+			withModulesLock(false, magicMount)
 			fmt.Printf("test function")
 			return
 		case "install":
@@ -95,12 +138,42 @@ func main() {
 			installModule(modulepath)
 			return
 		case "list":
-			modules, err := listModules()
+			listFlags := flag.NewFlagSet("module list", flag.ContinueOnError)
+			filter := listFlags.String("filter", "", "comma separated: enabled, disabled, update, remove, web, action")
+			sortKey := listFlags.String("sort", "id", "sort by id, name, author or versionCode")
+			schema := listFlags.Int("schema", 0, "print the versioned list of this schema")
+			if err := listFlags.Parse(args[2:]); err != nil {
+				os.Exit(2)
+			}
+			if *schema != 0 && *schema != moduleListSchema {
+				fmt.Printf("Error: unknown schema %d, the latest is %d\n", *schema, moduleListSchema)
+				os.Exit(2)
+			}
+
+			var modules []ModuleInfo
+			err := withModulesLock(false, func() (err error) {
+				modules, err = listModules()
+				return err
+			})
+			if err == nil {
+				modules, err = filterModules(modules, *filter)
+			}
+			if err == nil {
+				err = sortModules(modules, *sortKey)
+			}
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
-			jsonOutput, err := json.MarshalIndent(modules, "", "  ")
+			var output interface{} = moduleList{Schema: moduleListSchema, Modules: modules}
+			if *schema == 0 {
+				legacy := make([]map[string]string, len(modules))
+				for i := range modules {
+					legacy[i] = modules[i].legacy()
+				}
+				output = legacy
+			}
+			jsonOutput, err := json.MarshalIndent(output, "", "  ")
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
@@ -111,7 +184,10 @@ func main() {
 			if len(args) < 3 {
 				break
 			}
-			if err := enableModule(args[2], true); err != nil {
+			err := withModulesLock(true, func() error {
+				return enableModule(args[2], true)
+			})
+			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
 			return
@@ -119,12 +195,220 @@ func main() {
 			if len(args) < 3 {
 				break
 			}
-			if err := enableModule(args[2], false); err != nil {
+			err := withModulesLock(true, func() error {
+				return enableModule(args[2], false)
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			return
+		case "state":
+			if len(args) < 3 {
+				break
+			}
+			id := args[2]
+			if len(args) > 3 {
+				if err := checkUserTransition(moduleTransition(args[3])); err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(2)
+				}
+			}
+			var state moduleState
+			err := withModulesLock(len(args) > 3, func() error {
+				if len(args) > 3 {
+					if err := transitionModule(id, moduleTransition(args[3])); err != nil {
+						return err
+					}
+				}
+				state = readModuleState(id)
+				return nil
+			})
+			if err != nil {
 				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			jsonOutput, _ := json.MarshalIndent(state, "", "  ")
+			fmt.Println(string(jsonOutput))
+			return
+		case "action":
+			if len(args) < 3 {
+				break
+			}
+			jsonLines := len(args) > 3 && args[3] == "--json"
+			code, err := runModuleAction(args[2], &superkey, jsonLines)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			os.Exit(code)
+		case "webui":
+			if len(args) < 3 {
+				break
+			}
+			webuiFlags := flag.NewFlagSet("module webui", flag.ContinueOnError)
+			port := webuiFlags.Int("port", 0, "port to listen on, random when 0")
+			if err := webuiFlags.Parse(args[3:]); err != nil {
+				os.Exit(2)
+			}
+			if err := serveWebUI(args[2], &superkey, *port); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "verify":
+			if len(args) < 3 {
+				break
+			}
+			report, err := verifyModuleZip(args[2])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if len(args) > 3 && args[3] == "--json" {
+				jsonOutput, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(jsonOutput))
+			} else {
+				report.print(os.Stdout)
+			}
+			if !report.ok() {
+				os.Exit(1)
+			}
+			return
+		case "check-updates":
+			updateFlags := flag.NewFlagSet("module check-updates", flag.ContinueOnError)
+			jsonOutput := updateFlags.Bool("json", false, "print JSON")
+			force := updateFlags.Bool("force", false, "ignore cached results")
+			ignore := updateFlags.String("ignore", "", "stop checking updates of a module")
+			unignore := updateFlags.String("unignore", "", "check updates of an ignored module again")
+			if err := updateFlags.Parse(args[2:]); err != nil {
+				os.Exit(2)
+			}
+			if *ignore != "" || *unignore != "" {
+				var err error
+				if *ignore != "" {
+					err = setUpdateIgnore(*ignore, true)
+				}
+				if err == nil && *unignore != "" {
+					err = setUpdateIgnore(*unignore, false)
+				}
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				return
+			}
+			updates, err := checkUpdates(*force)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if *jsonOutput {
+				output, _ := json.MarshalIndent(updates, "", "  ")
+				fmt.Println(string(output))
+			} else {
+				printModuleUpdates(updates)
+			}
+			return
+		case "update":
+			if len(args) < 3 {
+				break
+			}
+			if err := updateModule(args[2]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "rollback":
+			if len(args) < 3 {
+				break
+			}
+			err := withModulesLock(true, func() error {
+				return rollbackModule(args[2])
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "pending":
+			pending, err := listPendingModules()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if len(args) > 2 && args[2] == "--json" {
+				jsonOutput, _ := json.MarshalIndent(pending, "", "  ")
+				fmt.Println(string(jsonOutput))
+				return
+			}
+			printPendingModules(pending)
+			return
+		case "uninstall":
+			if len(args) < 3 {
+				break
+			}
+			now := len(args) > 3 && args[3] == "--now"
+			err := withModulesLock(true, func() error {
+				return uninstallModule(args[2], now)
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "restore":
+			if len(args) < 3 {
+				break
+			}
+			err := withModulesLock(true, func() error {
+				return restoreModule(args[2])
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
 			}
 			return
 		case "disable_all_modules":
-			if err := disableAllModulesUpdate(); err != nil {
+			err := withModulesLock(true, func() error {
+				if err := snapshotEnabledModules(); err != nil {
+					return err
+				}
+				return disableAllModulesUpdate()
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			return
+		case "restore-enabled":
+			if err := withModulesLock(true, restoreEnabledModules); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			return
+		case "bisect":
+			if len(args) < 3 {
+				break
+			}
+			var err error
+			switch args[2] {
+			case "start":
+				err = withModulesLock(true, func() error {
+					return bisectStart(len(args) > 3 && args[3] == "--manual")
+				})
+			case "good", "bad":
+				err = withModulesLock(true, func() error {
+					return bisectVerdict(args[2] == "good")
+				})
+			case "reset":
+				err = withModulesLock(true, bisectReset)
+			case "status":
+				var state *bisectState
+				if state, err = bisectStatus(); err == nil {
+					jsonOutput, _ := json.MarshalIndent(state, "", "  ")
+					fmt.Println(string(jsonOutput))
+				}
+			default:
+				err = fmt.Errorf("unknown bisect command: %s", args[2])
+			}
+			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
 			return
@@ -133,12 +417,96 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage: apd module %s <argument>\n", moduleCmd)
 		return
 
+	case "status":
+		jsonOutput, err := json.MarshalIndent(getStatus(), "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println(string(jsonOutput))
+	case "scripts":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: apd scripts ps [--json]\n")
+			return
+		}
+		switch args[1] {
+		case "ps":
+			records, err := listScriptRecords()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			if len(args) > 2 && args[2] == "--json" {
+				jsonOutput, _ := json.MarshalIndent(records, "", "  ")
+				fmt.Println(string(jsonOutput))
+				return
+			}
+			printScriptRecords(records)
+		case "supervise":
+			// internal: started by runStageScripts for non-blocking stages
+			if len(args) < 3 {
+				return
+			}
+			if err := superviseStageScripts(args[2], &superkey); err != nil {
+				Error("supervise %s scripts failed: %v", args[2], err)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "Usage: apd scripts ps [--json]\n")
+		}
+	case "trust":
+		usage := "Usage: apd trust add <name> <key>|remove <name>|list|policy [off|warn|enforce]\n"
+		if len(args) < 2 {
+			fmt.Fprint(os.Stderr, usage)
+			return
+		}
+		var err error
+		switch {
+		case args[1] == "add" && len(args) > 3:
+			_, err = addTrustKey(args[2], args[3])
+		case args[1] == "remove" && len(args) > 2:
+			err = removeTrustKey(args[2])
+		case args[1] == "list":
+			var keys []trustKey
+			if keys, err = listTrustKeys(); err == nil {
+				jsonOutput, _ := json.MarshalIndent(keys, "", "  ")
+				fmt.Println(string(jsonOutput))
+			}
+		case args[1] == "policy" && len(args) > 2:
+			err = setTrustPolicy(args[2])
+		case args[1] == "policy":
+			fmt.Println(readTrustPolicy())
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "hooks":
+		// internal: started after boot-completed when modules declare prop_hooks
+		if len(args) < 2 || args[1] != "watch" {
+			fmt.Fprintf(os.Stderr, "Usage: apd hooks watch\n")
+			return
+		}
+		if err := watchPropHooks(&superkey); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
 	case "post-fs-data":
 		on_post_fs_data(superkey)
 	case "services":
 		on_services(superkey)
 	case "boot-completed":
 		on_boot_completed(superkey)
+	case "boot-daemon":
+		if len(args) > 1 && args[1] == "--wait" {
+			bootDaemonWait(superkey)
+			return
+		}
+		if err := bootDaemon(superkey); err != nil {
+			Error("%v", err)
+			fmt.Printf("Error: %v\n", err)
+		}
 	case "supercall":
 		test(superkey)
 	case "getprop":
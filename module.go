@@ -2,7 +2,6 @@ package main
 
 import (
 	"archive/zip"
-	"bufio"
 	_ "embed"
 	"errors"
 	"fmt"
@@ -18,7 +17,7 @@ import (
 var installer string
 
 func loadSystemProp() error {
-	return foreachModule(true, func(module string) error {
+	return foreachModuleStep("system.prop", true, func(module string) error {
 		systemProp := filepath.Join(module, "system.prop")
 		if _, err := os.Stat(systemProp); os.IsNotExist(err) {
 			return nil
@@ -28,7 +27,7 @@ func loadSystemProp() error {
 
 		cmd := exec.Command(resetprop, "-n", "--file", systemProp)
 		if err := cmd.Run(); err != nil {
-			Error("failed to exec %s: %w", systemProp, err)
+			Error("failed to exec %s: %v", systemProp, err)
 			return fmt.Errorf("failed to exec %s: %w", systemProp, err)
 		}
 
@@ -36,7 +35,7 @@ func loadSystemProp() error {
 	})
 }
 func loadSEPolicyRule() error {
-	return foreachModule(true, func(module string) error {
+	return foreachModuleStep("sepolicy.rule", true, func(module string) error {
 		ruleFile := filepath.Join(module, "sepolicy.rule")
 		if _, err := os.Stat(ruleFile); os.IsNotExist(err) {
 			return nil
@@ -67,26 +66,21 @@ func pruneModules() error {
 
 		modulePath := filepath.Join(moduleDir, entry.Name())
 
-		if err := os.Remove(filepath.Join(modulePath, updateFileName)); err != nil {
-
+		state := readModuleState(entry.Name())
+		if state.Update {
+			if err := transitionModule(entry.Name(), transitionUpdated); err != nil {
+				Error("%v", err)
+			}
 		}
-
-		removeFilePath := filepath.Join(modulePath, removeFileName)
-		if _, err := os.Stat(removeFilePath); os.IsNotExist(err) {
+		if !state.Remove {
 			continue
 		}
 
 		Info("remove module: %s", modulePath)
+		runUninstaller(modulePath)
 
-		uninstaller := filepath.Join(modulePath, "uninstall.sh")
-		if _, err := os.Stat(uninstaller); !os.IsNotExist(err) {
-			if execErr := execScript(uninstaller, true); execErr != nil {
-				Error("failed to exec uninstaller: %v", execErr)
-			}
-		}
-
-		if err := os.RemoveAll(modulePath); err != nil {
-			Error("failed to remove %s: %v", modulePath, err)
+		if err := transitionModule(entry.Name(), transitionPurge); err != nil {
+			Error("%v", err)
 		}
 
 		updatedPath := filepath.Join(moduleupdateDir, entry.Name())
@@ -98,6 +92,16 @@ func pruneModules() error {
 	return nil
 }
 
+func runUninstaller(modulePath string) {
+	uninstaller := filepath.Join(modulePath, "uninstall.sh")
+	if _, err := os.Stat(uninstaller); !os.IsNotExist(err) {
+		env := moduleScriptEnv(scriptEnv("uninstall", nil), modulePath)
+		if execErr := execScript(uninstaller, env, true); execErr != nil {
+			Error("failed to exec uninstaller: %v", execErr)
+		}
+	}
+}
+
 func foreachModule(active bool, fn func(module string) error) error {
 	entries, err := os.ReadDir(moduleDir)
 	if err != nil {
@@ -122,32 +126,19 @@ func foreachModule(active bool, fn func(module string) error) error {
 	}
 	return nil
 }
-func execCommonScripts(dir string, wait bool) error {
-	scriptDir := filepath.Join(adbDir, dir)
-	if _, err := os.Stat(scriptDir); os.IsNotExist(err) {
-		Error("%s not exists, skip", scriptDir)
-		return nil
-	}
-
-	entries, err := os.ReadDir(scriptDir)
-	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", scriptDir, err)
-	}
-
-	for _, entry := range entries {
-		path := filepath.Join(scriptDir, entry.Name())
 
-		if !isExecutable(path) {
-			Warn("%s is not executable, skip", path)
-			continue
-		}
-
-		if err := execScript(path, wait); err != nil {
-			return err
+// foreachModuleStep is foreachModule for the boot handler steps. A panic
+// is logged against the step and the module, and the remaining modules
+// still get their turn.
+func foreachModuleStep(step string, active bool, fn func(module string) error) error {
+	return foreachModule(active, func(module string) error {
+		err := runModuleStep(step, module, func() error { return fn(module) })
+		if _, panicked := err.(*stepPanic); panicked {
+			// already logged, carry on with the next module
+			return nil
 		}
-	}
-
-	return nil
+		return err
+	})
 }
 func isExecutable(path string) bool {
 	fileInfo, err := os.Stat(path)
@@ -156,74 +147,86 @@ func isExecutable(path string) bool {
 	}
 	return fileInfo.Mode().Perm()&0111 != 0
 }
-func execScript(path string, wait bool) error {
-	Info("exec %s", path)
 
+// scriptEnv returns the environment shared by every script apd runs during
+// the given stage. Module scripts additionally get moduleScriptEnv.
+func scriptEnv(stage string, superkey *string) []string {
+	env := os.Environ()
+	env = append(env, "ASH_STANDALONE=1")
+	env = append(env, "APATCH=true")
+	env = append(env, "APATCH_BIND_MOUNT=true")
+	env = append(env, fmt.Sprintf("APATCH_VER=APatch:%s", Version))
+	env = append(env, fmt.Sprintf("APATCH_VER_CODE=%s", Version))
+	env = append(env, fmt.Sprintf("APATCH_STAGE=%s", stage))
+	if tmpPath, err := getTmpPath(); err == nil {
+		env = append(env, fmt.Sprintf("APATCH_TMP=%s", tmpPath))
+	}
+	env = append(env, fmt.Sprintf("PATH=%s:%s", os.Getenv("PATH"), "/data/adb/ap/bin"))
+	if superkey != nil {
+		if ver := scKernelPatchVersion(*superkey); ver > 0 {
+			env = append(env, "KERNELPATCH=true")
+			env = append(env, fmt.Sprintf("KERNELPATCH_VERSION=%d", ver))
+		}
+	}
+	return env
+}
+
+func moduleScriptEnv(env []string, modulePath string) []string {
+	env = append(env[:len(env):len(env)], fmt.Sprintf("MODDIR=%s", modulePath))
+	env = append(env, fmt.Sprintf("MODPATH=%s", modulePath))
+	env = append(env, fmt.Sprintf("MODID=%s", filepath.Base(modulePath)))
+	return env
+}
+
+// scriptCommand prepares a module script to run in its own process group
+// under the busybox shell.
+func scriptCommand(path string, env []string) *exec.Cmd {
 	cmd := exec.Command(busybox, "sh", path)
 	cmd.Dir = filepath.Dir(path)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	cmd.Env = env
+	return cmd
+}
 
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "ASH_STANDALONE=1")
-	cmd.Env = append(cmd.Env, "APATCH=true")
-	cmd.Env = append(cmd.Env, "APATCH_BIND_MOUNT=true")
-	cmd.Env = append(cmd.Env, fmt.Sprintf("APATCH_VER=APatch:%s", Version))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("APATCH_VER_CODE=%s", Version))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("PATH=%s:%s", os.Getenv("PATH"), "/data/adb/ap/bin"))
+func startScript(path string, env []string) (*exec.Cmd, error) {
+	Info("exec %s", path)
 
-	var err error
-	err = cmd.Start()
-	if err != nil {
-		return fmt.Errorf("Failed to exec %s: %w", path, err)
+	cmd := scriptCommand(path, env)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to exec %s: %w", path, err)
 	}
 	childPID := cmd.Process.Pid
 	switchCgroups(childPID)
-	if wait {
-		err = cmd.Wait()
-
-	}
-
-	return nil
+	return cmd, nil
 }
-func ExecStageScript(stage string, block bool) error {
-	entries, err := os.ReadDir(moduleDir)
+func execScript(path string, env []string, wait bool) error {
+	cmd, err := startScript(path, env)
 	if err != nil {
 		return err
 	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		disableFilePath := filepath.Join(moduleDir, entry.Name(), disableFileName)
-		// Check if the disable file exists
-		if _, err := os.Stat(disableFilePath); err == nil {
-			// Disable file exists, skip this module
-			continue
-		}
-
-		scriptPath := filepath.Join(moduleDir, entry.Name(), fmt.Sprintf("%s.sh", stage))
-		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-			// Skip if the script does not exist
-			continue
-		}
-
-		if err := execScript(scriptPath, block); err != nil {
-			fmt.Printf("failed to exec script %s: %w", scriptPath, err)
-			continue
+	if wait {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("%s exited: %w", path, err)
 		}
 	}
+
 	return nil
 }
+func loadModuleProp(modulePath string) (*ModuleProp, error) {
+	file, err := os.Open(filepath.Join(modulePath, "module.prop"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseModuleProp(file)
+}
 func markUpdate() error {
 	updateFilePath := fmt.Sprintf("%s/%s", workingDir, updateFileName)
 	return ensureFileExists(updateFilePath)
 }
-func readModuleProp(zipPath string) (map[string]string, error) {
-	prop := make(map[string]string)
-
+func readModuleProp(zipPath string) (*ModuleProp, error) {
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return nil, err
@@ -237,64 +240,47 @@ func readModuleProp(zipPath string) (map[string]string, error) {
 				return nil, err
 			}
 			defer rc.Close()
-			scanner := bufio.NewScanner(rc)
-			for scanner.Scan() {
-				line := scanner.Text()
-				parts := strings.SplitN(line, "=", 2)
-				if len(parts) == 2 {
-					key := strings.TrimSpace(parts[0])
-					value := strings.TrimSpace(parts[1])
-					prop[key] = value
-				}
-			}
+			return parseModuleProp(rc)
 		}
 	}
-	return prop, nil
+	return nil, errors.New("module.prop not found in zip")
 }
 
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
+// copyZipPrivate copies a module zip, and its detached signature if any,
+// into a directory only root can access and returns the path of the copy.
+func copyZipPrivate(src string) (string, error) {
+	if err := os.MkdirAll(installZipDir, 0700); err != nil {
+		return "", err
 	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		if err := extractFile(f, dest); err != nil {
-			return err
-		}
+	if err := os.Chmod(installZipDir, 0700); err != nil {
+		return "", err
 	}
-	return nil
-}
-func extractFile(f *zip.File, dest string) error {
-	path := filepath.Join(dest, f.Name)
-
-	if !strings.HasPrefix(path, filepath.Clean(dest)+string(os.PathSeparator)) {
-		return fmt.Errorf("%s: illegal file path", f.Name)
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
 	}
+	defer in.Close()
 
-	if f.FileInfo().IsDir() {
-		return os.MkdirAll(path, 0755)
+	out, err := os.CreateTemp(installZipDir, "install-*.zip")
+	if err != nil {
+		return "", err
 	}
-
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
 	}
-
-	outFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.Mode())
-	if err != nil {
-		return err
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
 	}
-	defer outFile.Close()
-
-	rc, err := f.Open()
-	if err != nil {
-		return err
+	if sig, err := os.ReadFile(src + ".sig"); err == nil {
+		if err := os.WriteFile(out.Name()+".sig", sig, 0600); err != nil {
+			os.Remove(out.Name())
+			return "", err
+		}
 	}
-	defer rc.Close()
-
-	_, err = io.Copy(outFile, rc)
-	return err
+	return out.Name(), nil
 }
 
 func installModule(zip string) error {
@@ -303,48 +289,71 @@ func installModule(zip string) error {
 		Error("Boot is not Completed")
 		return err
 	}
+	lock, err := lockModules(true)
+	if err != nil {
+		Error("%v", err)
+		return err
+	}
+	defer lock.Unlock()
 	if err := ensureDirExists(workingDir); err != nil {
-		Error("failed to create working dir: %w", err)
+		Error("failed to create working dir: %v", err)
 		return fmt.Errorf("failed to create working dir: %w", err)
 	}
 	if err := ensureDirExists(binaryDir); err != nil {
-		Error("failed to create working dir: %w", err)
+		Error("failed to create working dir: %v", err)
 		return fmt.Errorf("failed to create bin dir: %w", err)
 	}
 
-	moduleProp, err := readModuleProp(zip)
+	// verification, the signature check and the installer all read a
+	// private copy, the given zip may sit on storage apps can write to
+	source := zip
+	zip, err = copyZipPrivate(source)
 	if err != nil {
-		Error("failed to readProp: %w", err)
+		Error("failed to copy %s: %v", source, err)
 		return err
 	}
-	//fmt.Printf("Module prop: %+v\n", moduleProp)
+	defer os.Remove(zip)
+	defer os.Remove(zip + ".sig")
 
-	moduleID, ok := moduleProp["id"]
-	if moduleID == "" {
-		Error("unable to install module, no id found")
-		return errors.New("unable to install module")
+	report, err := verifyModuleZip(zip)
+	if err != nil {
+		Error("failed to verify %s: %v", zip, err)
+		return err
+	}
+	report.print(os.Stdout)
+	if !report.ok() {
+		Error("module %s failed verification", zip)
+		return fmt.Errorf("module %s failed verification", zip)
 	}
-	if !ok {
-		Error("module id not found in module.prop")
-		return fmt.Errorf("module id not found in module.prop")
+	if err := checkModuleTrust(zip); err != nil {
+		return err
 	}
 
-	modulesDir := filepath.Join(moduleDir, moduleID)
-	//modulesUpdateDir := filepath.Join(moduleUpdateTmpDir, moduleID)
+	moduleProp, err := readModuleProp(zip)
+	if err != nil {
+		Error("failed to readProp: %v", err)
+		return err
+	}
+	//fmt.Printf("Module prop: %+v\n", moduleProp)
 
-	if err := ensureDirExists(modulesDir); err != nil {
-		Error("failed to create module folder: %w", err)
-		return fmt.Errorf("failed to create module folder: %w", err)
+	if err := moduleProp.validate(); err != nil {
+		Error("unable to install module: %v", err)
+		return fmt.Errorf("unable to install module: %w", err)
 	}
+	moduleID := moduleProp.ID
 
-	err = unzip(zip, modulesDir)
-	if err != nil {
-		Error("Unzip Failed： %w", err)
+	before := readModuleState(moduleID)
+
+	if err := journalModule(moduleID, journalStaging, func(entry *journalEntry) {
+		entry.Zip = source
+		entry.Version = moduleProp.Version
+		entry.VersionCode = moduleProp.VersionCode
+	}); err != nil {
+		Error("failed to write install journal: %v", err)
 		return err
 	}
-	//fmt.Println(modulesUpdateDir)
 
-	args := []string{"sh", "-c", installer}
+	cmd := exec.Command(busybox, "sh", "-c", installer)
 
 	//cmd := exec.Command(busybox, args...)
 	//cmd.Env = os.Environ()
@@ -364,6 +373,12 @@ func installModule(zip string) error {
 	env = append(env, fmt.Sprintf("APATCH_VER_CODE=%s", Version))
 	env = append(env, "OUTFD=1")
 	env = append(env, fmt.Sprintf("ZIPFILE=%s", zip))
+	if lock.file != nil {
+		// the installer gets the locked descriptor as fd 3, and closes it
+		// while module code runs
+		cmd.ExtraFiles = []*os.File{lock.file}
+		env = append(env, fmt.Sprintf("%s=3", modulesLockFdEnv))
+	}
 	//var out bytes.Buffer
 	//var stderr bytes.Buffer
 	//cmd.Stdout = &out
@@ -391,73 +406,98 @@ func installModule(zip string) error {
 	//	fmt.Println("installer error:", err)
 	//}
 
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
 	markUpdate()
-	return syscall.Exec(busybox, args, env)
+	if err := cmd.Run(); err != nil {
+		abortInstall(moduleID, before, err)
+		return fmt.Errorf("installer failed: %w", err)
+	}
+	if err := journalModule(moduleID, journalStaged, nil); err != nil {
+		Error("failed to write install journal: %v", err)
+	}
+	Info("module %s staged, active after reboot", moduleID)
+	return nil
 }
 func enableModule(id string, enable bool) error {
-	srcModulePath := filepath.Join(moduleDir, id)
-	_, err := os.Stat(srcModulePath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("module: %s not found", id)
-	} else if err != nil {
+	if enable {
+		return transitionModule(id, transitionEnable)
+	}
+	return transitionModule(id, transitionDisable)
+}
+
+func disableAllModulesUpdate() error {
+	entries, err := os.ReadDir(moduleDir)
+	if err != nil {
 		return err
 	}
 
-	disablePath := filepath.Join(srcModulePath, disableFileName)
-	if enable {
-		if _, err := os.Stat(disablePath); err == nil {
-			if err := os.Remove(disablePath); err != nil {
-				return fmt.Errorf("failed to remove disable file: %s, error: %v", disablePath, err)
-			}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
 		}
-	} else {
-		if err := ensureFileExists(disablePath); err != nil {
-			return err
+		if err := transitionModule(entry.Name(), transitionDisable); err != nil {
+			Error("failed to disable module: %v", err)
 		}
 	}
-	if err := markModuleState(moduleDir, id, disableFileName, !enable); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func markModuleState(moduleDir string, module string, flagFile string, createOrDelete bool) error {
-	moduleStateFile := filepath.Join(moduleDir, module, flagFile)
-	fmt.Println(moduleDir, module, flagFile, createOrDelete, moduleStateFile)
-	if createOrDelete {
-		return ensureFileExists(moduleStateFile)
-	} else {
-		if _, err := os.Stat(moduleStateFile); err == nil {
-			if err := os.Remove(moduleStateFile); err != nil {
-				return fmt.Errorf("failed to remove file: %s, error: %v", moduleStateFile, err)
-			}
+func enabledModuleIds() ([]string, error) {
+	var ids []string
+	err := foreachModule(true, func(module string) error {
+		if fileExists(filepath.Join(module, removeFileName)) {
+			return nil
 		}
+		ids = append(ids, filepath.Base(module))
 		return nil
-	}
+	})
+	return ids, err
 }
-func disableAllModulesUpdate() error {
-	entries, err := os.ReadDir(moduleDir)
+
+// snapshotEnabledModules records the enabled set before it gets wiped, unless
+// an earlier snapshot has not been restored yet.
+func snapshotEnabledModules() error {
+	if fileExists(enabledSnapshotFile) {
+		Info("keeping existing snapshot %s", enabledSnapshotFile)
+		return nil
+	}
+	ids, err := enabledModuleIds()
 	if err != nil {
 		return err
 	}
+	data := strings.Join(ids, "\n")
+	if len(ids) > 0 {
+		data += "\n"
+	}
+	return writeFileAtomic(enabledSnapshotFile, []byte(data), 0600)
+}
 
-	for _, entry := range entries {
-		if !entry.IsDir() {
+func restoreEnabledModules() error {
+	data, err := os.ReadFile(enabledSnapshotFile)
+	if os.IsNotExist(err) {
+		return errors.New("no enabled modules snapshot found")
+	} else if err != nil {
+		return err
+	}
+
+	for _, id := range strings.Fields(string(data)) {
+		if !fileExists(filepath.Join(moduleDir, id)) {
+			Warn("module %s no longer installed, skip", id)
 			continue
 		}
-
-		path := filepath.Join(moduleDir, entry.Name())
-		disableFlag := filepath.Join(path, disableFileName)
-		if err := ensureFileExists(disableFlag); err != nil {
-			fmt.Printf("Failed to disable module: %s: %v\n", path, err)
+		if err := enableModule(id, true); err != nil {
+			return err
 		}
 	}
-	return nil
+	return os.Remove(enabledSnapshotFile)
 }
 
-func listModules() ([]map[string]string, error) {
-	modules := []map[string]string{}
+func listModules() ([]ModuleInfo, error) {
+	modules := []ModuleInfo{}
 
 	entries, err := os.ReadDir(moduleDir)
 	if err != nil {
@@ -469,55 +509,29 @@ func listModules() ([]map[string]string, error) {
 			continue
 		}
 
-		modulePropPath := filepath.Join(moduleDir, entry.Name(), "module.prop")
-		if _, err := os.Stat(modulePropPath); os.IsNotExist(err) {
-			continue
-		}
-
-		file, err := os.Open(modulePropPath)
+		prop, err := loadModuleProp(filepath.Join(moduleDir, entry.Name()))
 		if err != nil {
-			//fmt.Printf("Failed to read file: %s\n", modulePropPath)
-			continue
-		}
-		defer file.Close()
-
-		modulePropMap := make(map[string]string)
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				modulePropMap[key] = value
-			}
-		}
-
-		if err := scanner.Err(); err != nil {
-			//fmt.Printf("Failed to parse module.prop: %s\n", modulePropPath)
 			continue
 		}
 
-		if id, exists := modulePropMap["id"]; !exists || id == "" {
-			id := entry.Name()
+		if prop.ID == "" {
 			//fmt.Printf("Use dir name as module id: %s\n", id)
-			modulePropMap["id"] = id
+			prop.ID = entry.Name()
 		}
 
-		// Add enabled, update, remove flags
-		enabled := !fileExists(filepath.Join(moduleDir, entry.Name(), disableFileName))
-		update := fileExists(filepath.Join(moduleDir, entry.Name(), updateFileName))
-		remove := fileExists(filepath.Join(moduleDir, entry.Name(), removeFileName))
-		web := fileExists(filepath.Join(moduleDir, entry.Name(), moduleWebDir))
-		action := fileExists(filepath.Join(moduleDir, entry.Name(), moduleActionSh))
-
-		modulePropMap["enabled"] = fmt.Sprintf("%t", enabled)
-		modulePropMap["update"] = fmt.Sprintf("%t", update)
-		modulePropMap["remove"] = fmt.Sprintf("%t", remove)
-		modulePropMap["web"] = fmt.Sprintf("%t", web)
-		modulePropMap["action"] = fmt.Sprintf("%t", action)
+		module := ModuleInfo{
+			ModuleProp: *prop,
+			Enabled:    !fileExists(filepath.Join(moduleDir, entry.Name(), disableFileName)),
+			Update:     fileExists(filepath.Join(moduleDir, entry.Name(), updateFileName)),
+			Remove:     fileExists(filepath.Join(moduleDir, entry.Name(), removeFileName)),
+			Web:        fileExists(filepath.Join(moduleDir, entry.Name(), moduleWebDir)),
+			Action:     fileExists(filepath.Join(moduleDir, entry.Name(), moduleActionSh)),
+		}
+		if results, err := readKmodStatus(entry.Name()); err == nil {
+			module.KernelModules = results
+		}
 
-		modules = append(modules, modulePropMap)
+		modules = append(modules, module)
 	}
 
 	return modules, nil
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// moduleListSchema is bumped whenever the JSON printed by `apd module list
+// --schema` changes in a way manager apps have to know about. Without
+// --schema the list keeps the array of string maps managers have always
+// parsed.
+const moduleListSchema = 1
+
+var moduleIDPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]+$`)
+
+// ModuleProp is the parsed module.prop of a module. Keys apd does not know
+// about are kept in Extra.
+type ModuleProp struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	VersionCode  int64             `json:"versionCode"`
+	Author       string            `json:"author"`
+	Description  string            `json:"description"`
+	UpdateJson   string            `json:"updateJson,omitempty"`
+	MountStage   string            `json:"mountStage,omitempty"`
+	Dependencies []string          `json:"dependencies,omitempty"`
+	Extra        map[string]string `json:"extra,omitempty"`
+
+	versionCodeErr error
+	// every key as read, for the legacy module list
+	raw map[string]string
+}
+
+func parseModuleProp(r io.Reader) (*ModuleProp, error) {
+	prop := &ModuleProp{Extra: map[string]string{}, raw: map[string]string{}}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		prop.raw[key] = value
+
+		switch key {
+		case "id":
+			prop.ID = value
+		case "name":
+			prop.Name = value
+		case "version":
+			prop.Version = value
+		case "versionCode":
+			prop.VersionCode, prop.versionCodeErr = strconv.ParseInt(value, 10, 64)
+		case "author":
+			prop.Author = value
+		case "description":
+			prop.Description = value
+		case "updateJson":
+			prop.UpdateJson = value
+		case "mountStage":
+			prop.MountStage = value
+		case "dependencies":
+			for _, dep := range strings.Split(value, ",") {
+				if dep = strings.TrimSpace(dep); dep != "" {
+					prop.Dependencies = append(prop.Dependencies, dep)
+				}
+			}
+		default:
+			if key != "" && !strings.HasPrefix(key, "#") {
+				prop.Extra[key] = value
+			}
+		}
+	}
+	if len(prop.Extra) == 0 {
+		prop.Extra = nil
+	}
+	return prop, scanner.Err()
+}
+
+// validate checks the fields an installable module must have.
+func (p *ModuleProp) validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("module id not found in module.prop")
+	}
+	if !moduleIDPattern.MatchString(p.ID) {
+		return fmt.Errorf("invalid module id %q", p.ID)
+	}
+	if p.versionCodeErr != nil {
+		return fmt.Errorf("invalid versionCode: %v", p.versionCodeErr)
+	}
+	return nil
+}
+
+// ModuleInfo is one entry of `apd module list`.
+type ModuleInfo struct {
+	ModuleProp
+	Enabled       bool         `json:"enabled"`
+	Update        bool         `json:"update"`
+	Remove        bool         `json:"remove"`
+	Web           bool         `json:"web"`
+	Action        bool         `json:"action"`
+	KernelModules []kmodResult `json:"kernel_modules,omitempty"`
+}
+
+// legacy returns the entry as the string map `apd module list` printed
+// before the schema was introduced, module.prop keys as they are and the
+// flags as "true" or "false".
+func (m *ModuleInfo) legacy() map[string]string {
+	entry := make(map[string]string, len(m.raw)+6)
+	for key, value := range m.raw {
+		entry[key] = value
+	}
+	entry["id"] = m.ID
+	entry["enabled"] = strconv.FormatBool(m.Enabled)
+	entry["update"] = strconv.FormatBool(m.Update)
+	entry["remove"] = strconv.FormatBool(m.Remove)
+	entry["web"] = strconv.FormatBool(m.Web)
+	entry["action"] = strconv.FormatBool(m.Action)
+	return entry
+}
+
+type moduleList struct {
+	Schema  int          `json:"schema"`
+	Modules []ModuleInfo `json:"modules"`
+}
+
+var moduleFilters = map[string]func(m *ModuleInfo) bool{
+	"enabled":  func(m *ModuleInfo) bool { return m.Enabled },
+	"disabled": func(m *ModuleInfo) bool { return !m.Enabled },
+	"update":   func(m *ModuleInfo) bool { return m.Update },
+	"remove":   func(m *ModuleInfo) bool { return m.Remove },
+	"web":      func(m *ModuleInfo) bool { return m.Web },
+	"action":   func(m *ModuleInfo) bool { return m.Action },
+}
+
+var moduleSorts = map[string]func(a, b *ModuleInfo) bool{
+	"id":          func(a, b *ModuleInfo) bool { return a.ID < b.ID },
+	"name":        func(a, b *ModuleInfo) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) },
+	"author":      func(a, b *ModuleInfo) bool { return strings.ToLower(a.Author) < strings.ToLower(b.Author) },
+	"versionCode": func(a, b *ModuleInfo) bool { return a.VersionCode < b.VersionCode },
+}
+
+// filterModules keeps the modules matching every comma separated filter.
+func filterModules(modules []ModuleInfo, filters string) ([]ModuleInfo, error) {
+	if filters == "" {
+		return modules, nil
+	}
+	var checks []func(m *ModuleInfo) bool
+	for _, name := range strings.Split(filters, ",") {
+		check, ok := moduleFilters[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+		checks = append(checks, check)
+	}
+
+	filtered := []ModuleInfo{}
+	for i := range modules {
+		keep := true
+		for _, check := range checks {
+			keep = keep && check(&modules[i])
+		}
+		if keep {
+			filtered = append(filtered, modules[i])
+		}
+	}
+	return filtered, nil
+}
+
+func sortModules(modules []ModuleInfo, key string) error {
+	less, ok := moduleSorts[key]
+	if !ok {
+		return fmt.Errorf("unknown sort key %q", key)
+	}
+	sort.SliceStable(modules, func(i, j int) bool {
+		return less(&modules[i], &modules[j])
+	})
+	return nil
+}
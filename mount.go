@@ -124,11 +124,38 @@ func (n *Node) collectModuleFiles(moduleDir string) (bool, error) {
 	return hasFile, nil
 }
 
+// moduleMountStage returns the stage a module asked its files to be mounted
+// at with the mountStage key of module.prop, post-fs-data by default.
+func moduleMountStage(modPath string) string {
+	prop, err := loadModuleProp(modPath)
+	if err != nil {
+		return "post-fs-data"
+	}
+	switch stage := prop.MountStage; stage {
+	case "service", "boot-completed":
+		return stage
+	case "", "post-fs-data":
+	default:
+		Warn("module %s: unknown mountStage %q, using post-fs-data", filepath.Base(modPath), stage)
+	}
+	return "post-fs-data"
+}
+
 func collectAllModuleFiles() (*Node, error) {
+	return collectModuleTree(func(modPath string) bool {
+		return moduleMountStage(modPath) == "post-fs-data"
+	})
+}
+
+func collectModuleTree(include func(modPath string) bool) (*Node, error) {
 	root := newNodeRoot("")
 	system := newNodeRoot("system")
 	var hasFile bool
 
+	if state, err := readSafeMode(); err == nil && state.SafeMode {
+		return nil, nil
+	}
+
 	moduleRoot := filepath.Clean(MODULE_DIR)
 	entries, err := os.ReadDir(moduleRoot)
 	if err != nil {
@@ -145,6 +172,9 @@ func collectAllModuleFiles() (*Node, error) {
 		if exists(filepath.Join(modPath, DISABLE_FILE_NAME)) || exists(filepath.Join(modPath, SKIP_MOUNT_FILE_NAME)) {
 			continue
 		}
+		if !include(modPath) {
+			continue
+		}
 
 		modSystem := filepath.Join(modPath, "system")
 		if info, err := os.Stat(modSystem); err != nil || !info.IsDir() {
@@ -246,16 +276,31 @@ func mountDevpts(dest string) error {
 	}
 	return nil
 }
-func mountTmpfs(dest string) error {
+func mountTmpfs(dest string, mode os.FileMode) error {
 
-	if err := os.MkdirAll(dest, 0755); err != nil {
+	if err := os.MkdirAll(dest, mode); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", dest, err)
 	}
 
-	if err := unix.Mount("tmpfs", dest, "tmpfs", 0, ""); err != nil {
+	if err := unix.Mount("tmpfs", dest, "tmpfs", 0, fmt.Sprintf("mode=%o", mode)); err != nil {
 		return fmt.Errorf("failed to mount tmpfs on %s: %w", dest, err)
 	}
 
+	if err := setupTmpfs(dest); err != nil {
+		// don't leave a half set up tmpfs over dest
+		if uerr := unix.Unmount(dest, unix.MNT_DETACH); uerr != nil {
+			Warn("failed to unmount %s: %v", dest, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func setupTmpfs(dest string) error {
+	if err := unix.Mount("", dest, "", unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make %s private: %w", dest, err)
+	}
+
 	ptsDir := fmt.Sprintf("%s/pts", dest)
 	if err := os.MkdirAll(ptsDir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", ptsDir, err)
@@ -283,7 +328,7 @@ func cloneSymlink(src, dst string) error {
 
 	con, err := lgetFileCon(src)
 	if err != nil {
-		return fmt.Errorf("get file context %s failed: %w", src, dst)
+		return fmt.Errorf("get file context %s failed: %w", src, err)
 	}
 	if err := lsetFileCon(dst, con); err != nil {
 		fmt.Printf("create symlink %s -> %s ", src, srcSymlink)
@@ -298,11 +343,55 @@ func magicMount() error {
 	if err != nil {
 		return err
 	}
+	return mountModuleTree(rootNode)
+}
+
+// magicMountStage is the second pass for modules that deferred their mounts
+// to a later stage. Each module's tree is grafted on its own onto the view
+// left by the earlier passes, so one failing module does not hold up the
+// others.
+func magicMountStage(stage string) error {
+	entries, err := os.ReadDir(MODULE_DIR)
+	if err != nil {
+		return fmt.Errorf("failed to read modules directory: %w", err)
+	}
 
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		modPath := filepath.Join(MODULE_DIR, entry.Name())
+		if moduleMountStage(modPath) != stage {
+			continue
+		}
+
+		rootNode, err := collectModuleTree(func(path string) bool {
+			return path == modPath
+		})
+		if err != nil {
+			Error("collect files of %s failed: %v", entry.Name(), err)
+			continue
+		}
+		if rootNode == nil {
+			continue
+		}
+		Info("late mount of %s at %s", entry.Name(), stage)
+		if err := mountModuleTree(rootNode); err != nil {
+			Error("late mount of %s failed: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+func mountModuleTree(rootNode *Node) error {
 	if rootNode == nil {
 		return nil
 	}
-	tmpDir := filepath.Join(getWorkDir(), "overlay_tmp")
+	workDir, err := getWorkDir()
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(workDir, "overlay_tmp")
 
 	if err := os.MkdirAll(tmpDir, 0755); err != nil {
 		return fmt.Errorf("ensure tmp dir exists: %w", err)
@@ -318,9 +407,11 @@ func magicMount() error {
 
 	resultErr := doMagicMount("/", tmpDir, rootNode, false)
 
-	//if umountErr := unix.Unmount(tmpDir, unix.MNT_DETACH); umountErr != nil {
-	//	fmt.Printf("Error: failed to unmount tmp %v\n", umountErr)
-	//}
+	// Each pass mounts a fresh tmpfs here; detach it so deferred stages
+	// don't stack one per module.
+	if err := unix.Unmount(tmpDir, unix.MNT_DETACH); err != nil {
+		Warn("failed to unmount %s: %v", tmpDir, err)
+	}
 
 	os.RemoveAll(tmpDir)
 
@@ -418,19 +509,26 @@ func doMagicMount(
 
 			var metadata os.FileInfo
 			var sourcePath string
+			var err error
 
 			if exists(path) {
-				metadata, _ = os.Stat(path)
+				metadata, err = os.Stat(path)
 				sourcePath = path
 			} else if current.ModulePath != "" && exists(current.ModulePath) {
-				metadata, _ = os.Stat(current.ModulePath)
+				metadata, err = os.Stat(current.ModulePath)
 				sourcePath = current.ModulePath
 			} else {
 
 				return fmt.Errorf("cannot get metadata for dir %s", path)
 			}
+			if err != nil {
+				return fmt.Errorf("cannot get metadata for dir %s: %w", path, err)
+			}
 
-			sysStat := metadata.Sys().(*syscall.Stat_t)
+			sysStat, ok := metadata.Sys().(*syscall.Stat_t)
+			if !ok {
+				return fmt.Errorf("cannot get owner of %s", sourcePath)
+			}
 
 			if err := os.Chmod(workDirPath, metadata.Mode().Perm()); err != nil {
 				return fmt.Errorf("chmod %s failed: %w", workDirPath, err)
@@ -548,7 +646,10 @@ func mountMirror(path, workDirPath, entryPath string, info os.FileInfo) error {
 			return fmt.Errorf("create mirror dir %s failed: %w", workTargetDir, err)
 		}
 
-		sysStat := info.Sys().(*syscall.Stat_t)
+		sysStat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot get owner of mirror dir %s", targetPath)
+		}
 		if err := os.Chmod(workTargetDir, info.Mode().Perm()); err != nil {
 			return fmt.Errorf("chmod mirror dir %s failed: %w", workTargetDir, err)
 		}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// stepPanic is the error a recovered panic turns into.
+type stepPanic struct {
+	where string
+	value interface{}
+}
+
+func (p *stepPanic) Error() string {
+	return fmt.Sprintf("panic in %s: %v", p.where, p.value)
+}
+
+// runStep runs one step of a boot handler. A panic is turned into an
+// error, logged with its stack trace to ap_log, and the caller carries
+// on with its remaining steps.
+func runStep(step string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recordPanic(step, "", r)
+		}
+	}()
+	return fn()
+}
+
+// runModuleStep is runStep for work done on behalf of a single module
+// within step.
+func runModuleStep(step, module string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recordPanic(step, filepath.Base(module), r)
+		}
+	}()
+	return fn()
+}
+
+func recordPanic(step, module string, r interface{}) error {
+	where := step
+	if where == "" {
+		where = "unknown step"
+	}
+	if module != "" {
+		where = fmt.Sprintf("%s (module %s)", where, module)
+	}
+	stack := debug.Stack()
+
+	Error("panic in %s: %v", where, r)
+	Error("%s", stack)
+
+	if err := os.MkdirAll(ap_log, 0700); err == nil {
+		file, err := os.OpenFile(filepath.Join(ap_log, "panic.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(file, "[%s] panic in %s: %v\n%s\n", time.Now().Format(time.RFC3339), where, r, stack)
+			file.Close()
+		}
+	}
+	return &stepPanic{where: where, value: r}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	EV_KEY         = 0x01
+	KEY_VOLUMEDOWN = 114
+	KEY_MAX        = 0x2ff
+
+	safeModeBootParam = "androidboot.apatch_safemode"
+	safeModeKeyWindow = 1500 * time.Millisecond
+)
+
+// safeModeState is decided once at post-fs-data and reused by the later
+// stages of the same boot.
+type safeModeState struct {
+	SafeMode bool   `json:"safe_mode"`
+	Reason   string `json:"reason,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+func safeModeFile() string {
+	return filepath.Join(runDir, "safemode")
+}
+
+func readSafeMode() (*safeModeState, error) {
+	data, err := os.ReadFile(safeModeFile())
+	if err != nil {
+		return nil, err
+	}
+	state := &safeModeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// initSafeMode runs every safe mode trigger, including the volume key
+// probe, and records the outcome for the rest of the boot.
+func initSafeMode(superkey *string) bool {
+	safeMode, reason := detectSafeMode(superkey, true)
+	if safeMode {
+		Warn("safe mode triggered by %s", reason)
+	}
+
+	state := &safeModeState{SafeMode: safeMode, Reason: reason, Time: time.Now().Unix()}
+	data, err := json.Marshal(state)
+	if err == nil {
+		if err := os.MkdirAll(runDir, 0700); err != nil {
+			Error("failed to create %s: %v", runDir, err)
+		} else if err := writeFileAtomic(safeModeFile(), data, 0600); err != nil {
+			Error("failed to record safe mode: %v", err)
+		}
+	}
+	return safeMode
+}
+
+// clearSafeModeMarker consumes the marker file once a safe mode boot has
+// completed, so it only asks for a single safe boot.
+func clearSafeModeMarker() {
+	if err := os.Remove(safeModeMarkerFile); err == nil {
+		Info("safe mode boot completed, removed %s", safeModeMarkerFile)
+	} else if !os.IsNotExist(err) {
+		Error("failed to remove %s: %v", safeModeMarkerFile, err)
+	}
+}
+
+func detectSafeMode(superkey *string, probeKeys bool) (bool, string) {
+	safemode, err := getprop("persist.sys.safemode")
+	if err == nil && safemode == "1" {
+		return true, "property persist.sys.safemode"
+	}
+	if superkey != nil {
+		ret := scSuGetSafemode(*superkey)
+		if ret == 1 {
+			return true, "kernel safemode"
+		} else if ret < 0 {
+			Error("scSuGetSafemode failed: %d", ret)
+		}
+	}
+	if value, ok := getBootParam(safeModeBootParam); ok && value != "0" && value != "false" {
+		return true, "boot parameter " + safeModeBootParam
+	}
+	if fileExists(safeModeMarkerFile) {
+		return true, "marker file " + safeModeMarkerFile
+	}
+	if probeKeys && volumeDownPressed(safeModeKeyWindow) {
+		return true, "volume down key"
+	}
+	return false, ""
+}
+
+// getBootParam looks a key up in the kernel cmdline and in bootconfig.
+func getBootParam(key string) (string, bool) {
+	if data, err := os.ReadFile("/proc/cmdline"); err == nil {
+		for _, field := range strings.Fields(string(data)) {
+			parts := strings.SplitN(field, "=", 2)
+			if parts[0] != key {
+				continue
+			}
+			if len(parts) == 2 {
+				return strings.Trim(parts[1], "\""), true
+			}
+			return "", true
+		}
+	}
+	if data, err := os.ReadFile("/proc/bootconfig"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+				return strings.Trim(strings.TrimSpace(parts[1]), "\""), true
+			}
+		}
+	}
+	return "", false
+}
+
+func eviocgkey(length int) uintptr {
+	return uintptr(2<<30 | length<<16 | 'E'<<8 | 0x18)
+}
+
+// volumeDownPressed reports whether volume down is held right now on any
+// input device, or gets pressed within the given window.
+func volumeDownPressed(window time.Duration) bool {
+	devices, _ := filepath.Glob("/dev/input/event*")
+
+	var fds []unix.PollFd
+	defer func() {
+		for _, pfd := range fds {
+			unix.Close(int(pfd.Fd))
+		}
+	}()
+
+	keys := make([]byte, (KEY_MAX+7)/8)
+	for _, device := range devices {
+		fd, err := unix.Open(device, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), eviocgkey(len(keys)), uintptr(unsafe.Pointer(&keys[0])))
+		if errno == 0 && keys[KEY_VOLUMEDOWN/8]&(1<<(KEY_VOLUMEDOWN%8)) != 0 {
+			Info("volume down held on %s", device)
+			return true
+		}
+	}
+	if len(fds) == 0 {
+		return false
+	}
+
+	var event inputEvent
+	buf := make([]byte, unsafe.Sizeof(event))
+	deadline := time.Now().Add(window)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		n, err := unix.Poll(fds, int(remaining/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		} else if err != nil || n == 0 {
+			return false
+		}
+
+		for _, pfd := range fds {
+			if pfd.Revents&unix.POLLIN == 0 {
+				continue
+			}
+			for {
+				if n, err := unix.Read(int(pfd.Fd), buf); err != nil || n != len(buf) {
+					break
+				}
+				event = *(*inputEvent)(unsafe.Pointer(&buf[0]))
+				if event.Type == EV_KEY && event.Code == KEY_VOLUMEDOWN && event.Value == 1 {
+					Info("volume down pressed")
+					return true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// scriptRecord is written to runDir/scripts when a stage script starts and
+// rewritten when it exits, so `apd scripts ps` can tell what each module
+// is running.
+type scriptRecord struct {
+	Stage    string `json:"stage"`
+	Module   string `json:"module,omitempty"`
+	Path     string `json:"path"`
+	Pid      int    `json:"pid"`
+	Start    int64  `json:"start"`
+	Exit     int64  `json:"exit,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Status   string `json:"status"`
+}
+
+type stageScript struct {
+	module string
+	path   string
+	env    []string
+}
+
+func scriptRecordDir() string {
+	return filepath.Join(runDir, "scripts")
+}
+
+func (s stageScript) recordPath(stage string) string {
+	name := s.module
+	switch {
+	case name == "":
+		name = "common-" + filepath.Base(s.path)
+	case filepath.Base(s.path) != stage+".sh":
+		// property hooks, one module may run several at once
+		name += "-" + filepath.Base(s.path)
+	}
+	return filepath.Join(scriptRecordDir(), fmt.Sprintf("%s.%s.json", stage, name))
+}
+
+func writeScriptRecord(path string, record *scriptRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		Warn("failed to record script %s: %v", record.Path, err)
+	}
+}
+
+// runTrackedScript starts a script, records its pid and waits for it.
+func runTrackedScript(stage string, script stageScript) error {
+	recordPath := script.recordPath(stage)
+	record := &scriptRecord{
+		Stage:  stage,
+		Module: script.module,
+		Path:   script.path,
+		Start:  time.Now().Unix(),
+	}
+
+	cmd, err := startScript(script.path, script.env)
+	if err != nil {
+		record.Error = err.Error()
+		record.Exit = record.Start
+		writeScriptRecord(recordPath, record)
+		return err
+	}
+	record.Pid = cmd.Process.Pid
+	writeScriptRecord(recordPath, record)
+
+	err = cmd.Wait()
+	record.Exit = time.Now().Unix()
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		record.ExitCode = &exitCode
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	writeScriptRecord(recordPath, record)
+
+	if err != nil {
+		return fmt.Errorf("%s exited: %w", script.path, err)
+	}
+	return nil
+}
+
+func runScriptsSequential(stage string, scripts []stageScript) {
+	for _, script := range scripts {
+		if err := runTrackedScript(stage, script); err != nil {
+			Error("failed to exec %s script: %v", stage, err)
+		}
+	}
+}
+
+// runScriptsParallel runs at most maxParallelScripts scripts at a time. A
+// script holds its slot until it exits or scriptSlotTimeout has passed,
+// its exit is still waited for and recorded after that.
+func runScriptsParallel(stage string, scripts []stageScript) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxParallelScripts)
+
+	for _, script := range scripts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(script stageScript) {
+			defer wg.Done()
+			exited := make(chan struct{})
+			defer close(exited)
+			go func() {
+				select {
+				case <-exited:
+				case <-time.After(scriptSlotTimeout):
+					Warn("%s script %s still running after %s", stage, script.path, scriptSlotTimeout)
+				}
+				<-sem
+			}()
+			// a panic here would take down the whole stage, not just
+			// this script
+			err := runModuleStep(stage+" scripts", script.module, func() error {
+				return runTrackedScript(stage, script)
+			})
+			if _, panicked := err.(*stepPanic); !panicked && err != nil {
+				Error("failed to exec %s script: %v", stage, err)
+			}
+		}(script)
+	}
+	wg.Wait()
+}
+
+func collectStageScripts(stage string, env []string) ([]stageScript, []stageScript, error) {
+	var common, modules []stageScript
+
+	scriptDir := filepath.Join(adbDir, fmt.Sprintf("%s.d", stage))
+	entries, err := os.ReadDir(scriptDir)
+	if err != nil && !os.IsNotExist(err) {
+		Error("failed to read directory %s: %v", scriptDir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(scriptDir, entry.Name())
+		if entry.IsDir() || !isExecutable(path) {
+			Warn("%s is not executable, skip", path)
+			continue
+		}
+		common = append(common, stageScript{path: path, env: env})
+	}
+
+	err = foreachModuleStep(stage+" scripts", true, func(module string) error {
+		scriptPath := filepath.Join(module, fmt.Sprintf("%s.sh", stage))
+		if !fileExists(scriptPath) {
+			return nil
+		}
+		modules = append(modules, stageScript{
+			module: filepath.Base(module),
+			path:   scriptPath,
+			env:    moduleScriptEnv(env, module),
+		})
+		return nil
+	})
+	return common, modules, err
+}
+
+// runStageScripts is the single runner for every boot stage. It executes
+// the common scripts in /data/adb/<stage>.d in filename order, then the
+// <stage>.sh of every enabled module. A failing script is logged and does
+// not stop the remaining ones. Non-blocking stages are handed to a
+// detached supervisor so init is not held up.
+func runStageScripts(stage string, superkey *string, block bool) error {
+	if !block {
+		return spawnScriptSupervisor(stage, superkey)
+	}
+	common, modules, err := collectStageScripts(stage, scriptEnv(stage, superkey))
+	runCollectedScripts(stage, common, modules)
+	return err
+}
+
+// superviseStageScripts runs in the detached supervisor. The modules are
+// only held shared while the scripts are collected, the scripts of the
+// later stages may run for as long as the device is up.
+func superviseStageScripts(stage string, superkey *string) error {
+	lock := lockModulesForBoot()
+	common, modules, err := collectStageScripts(stage, scriptEnv(stage, superkey))
+	lock.Unlock()
+	runCollectedScripts(stage, common, modules)
+	return err
+}
+
+func runCollectedScripts(stage string, common, modules []stageScript) {
+	if err := os.MkdirAll(scriptRecordDir(), 0700); err != nil {
+		Warn("failed to create %s: %v", scriptRecordDir(), err)
+	}
+
+	runScriptsSequential(stage, common)
+
+	switch {
+	case stage == "service" || stage == "boot-completed":
+		runScriptsParallel(stage, modules)
+	case stage == "post-fs-data" && fileExists(parallel_pfd_file):
+		// modules declaring dependencies run afterwards, in module order
+		var independent, dependent []stageScript
+		for _, script := range modules {
+			prop, err := loadModuleProp(filepath.Join(moduleDir, script.module))
+			if err == nil && len(prop.Dependencies) > 0 {
+				dependent = append(dependent, script)
+			} else {
+				independent = append(independent, script)
+			}
+		}
+		runScriptsParallel(stage, independent)
+		runScriptsSequential(stage, dependent)
+	default:
+		runScriptsSequential(stage, modules)
+	}
+}
+
+func spawnScriptSupervisor(stage string, superkey *string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	key := "none"
+	if superkey != nil {
+		key = *superkey
+	}
+
+	cmd := exec.Command(exe, "-s", key, "scripts", "supervise", stage)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s supervisor: %w", stage, err)
+	}
+	Info("%s scripts supervised by pid %d", stage, cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+func listScriptRecords() ([]scriptRecord, error) {
+	entries, err := os.ReadDir(scriptRecordDir())
+	if os.IsNotExist(err) {
+		return []scriptRecord{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	records := []scriptRecord{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(scriptRecordDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		var record scriptRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+
+		switch {
+		case record.ExitCode != nil:
+			record.Status = "exited"
+		case record.Pid == 0:
+			record.Status = "failed"
+		case fileExists(fmt.Sprintf("/proc/%d", record.Pid)):
+			record.Status = "running"
+		default:
+			record.Status = "lost"
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func printScriptRecords(records []scriptRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tMODULE\tPID\tSTATUS\tSTARTED\tEXIT\tPATH")
+	for _, r := range records {
+		module := r.Module
+		if module == "" {
+			module = "-"
+		}
+		exit := "-"
+		if r.ExitCode != nil {
+			exit = fmt.Sprintf("%d (%ds)", *r.ExitCode, r.Exit-r.Start)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Stage, module, r.Pid, r.Status,
+			time.Unix(r.Start, 0).Format("15:04:05"), exit, r.Path)
+	}
+	w.Flush()
+}
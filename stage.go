@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	stageRunning = "running"
+	stageDone    = "done"
+	// a running stage whose process is gone, or that ran past
+	// stageRunningTimeout, no longer holds back the stages after it
+	stageAbandoned = "abandoned"
+)
+
+// stageOrder lists the boot stages in the order init triggers them.
+// post-mount runs from inside post-fs-data.
+var stageOrder = []string{"post-fs-data", "post-mount", "service", "boot-completed"}
+
+// stagePrerequisite is the stage that must have been reached (running for
+// post-mount, done for the others) before a stage may start.
+var stagePrerequisite = map[string]string{
+	"post-mount":     "post-fs-data",
+	"service":        "post-fs-data",
+	"boot-completed": "service",
+}
+
+type stageRecord struct {
+	Status string `json:"status"`
+	Pid    int    `json:"pid,omitempty"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end,omitempty"`
+}
+
+// abandoned reports whether a running stage will never be done.
+func (r *stageRecord) abandoned() bool {
+	if r.Status != stageRunning {
+		return false
+	}
+	if r.Pid != 0 && !fileExists(fmt.Sprintf("/proc/%d", r.Pid)) {
+		return true
+	}
+	return time.Since(time.Unix(r.Start, 0)) > stageRunningTimeout
+}
+
+// stageState is kept in the tmpfs and keyed on the kernel boot id, so a
+// state left over from an earlier boot is never trusted.
+type stageState struct {
+	BootID string                  `json:"boot_id"`
+	Stages map[string]*stageRecord `json:"stages"`
+}
+
+type stageError struct {
+	stage     string
+	duplicate bool
+	msg       string
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("stage %s: %s", e.stage, e.msg)
+}
+
+func stageStateFile() string {
+	return filepath.Join(runDir, "stage.json")
+}
+
+func currentBootID() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readStageState() *stageState {
+	bootID := currentBootID()
+	state := &stageState{}
+
+	if data, err := os.ReadFile(stageStateFile()); err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			Warn("corrupted %s, resetting: %v", stageStateFile(), err)
+			state = &stageState{}
+		}
+	}
+	if state.BootID != bootID || state.Stages == nil {
+		state = &stageState{BootID: bootID, Stages: map[string]*stageRecord{}}
+	}
+	return state
+}
+
+func updateStageState(fn func(state *stageState) error) error {
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(runDir, "stage.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	state := readStageState()
+	if err := fn(state); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(stageStateFile(), data, 0600)
+}
+
+// beginStage claims a stage for this boot. It fails with a duplicate
+// stageError when the stage was already triggered, and refuses to start a
+// stage whose prerequisite has not been reached. A prerequisite left
+// running by a process that died or hung is marked abandoned instead.
+func beginStage(stage string) error {
+	return updateStageState(func(state *stageState) error {
+		if record, ok := state.Stages[stage]; ok {
+			return &stageError{stage: stage, duplicate: true, msg: "already " + record.Status}
+		}
+
+		if prerequisite, ok := stagePrerequisite[stage]; ok {
+			record, reached := state.Stages[prerequisite]
+			if !reached {
+				return &stageError{stage: stage, msg: prerequisite + " has not run"}
+			}
+			if stage != "post-mount" && record.abandoned() {
+				Warn("stage %s started at %s never finished, giving up on it",
+					prerequisite, time.Unix(record.Start, 0).Format("15:04:05"))
+				record.Status = stageAbandoned
+				record.End = time.Now().Unix()
+			}
+			if stage != "post-mount" && record.Status == stageRunning {
+				return &stageError{stage: stage, msg: prerequisite + " is still running"}
+			}
+		}
+
+		state.Stages[stage] = &stageRecord{Status: stageRunning, Pid: os.Getpid(), Start: time.Now().Unix()}
+		return nil
+	})
+}
+
+func endStage(stage string) {
+	err := updateStageState(func(state *stageState) error {
+		record, ok := state.Stages[stage]
+		if !ok {
+			return fmt.Errorf("stage %s was never started", stage)
+		}
+		record.Status = stageDone
+		record.End = time.Now().Unix()
+		return nil
+	})
+	if err != nil {
+		Error("failed to record end of %s: %v", stage, err)
+	}
+}
+
+// enterStage wraps beginStage for the event handlers: duplicates are
+// silently ignored, ordering violations are logged.
+func enterStage(stage string) bool {
+	err := beginStage(stage)
+	if err == nil {
+		return true
+	}
+	if stageErr, ok := err.(*stageError); ok && stageErr.duplicate {
+		Info("%v, ignoring duplicate trigger", err)
+	} else {
+		Error("refusing to run: %v", err)
+	}
+	return false
+}
+
+// latestStage returns the most advanced stage reached during this boot.
+func (s *stageState) latestStage() string {
+	latest := ""
+	for _, stage := range stageOrder {
+		if _, ok := s.Stages[stage]; ok {
+			latest = stage
+		}
+	}
+	return latest
+}
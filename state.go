@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// moduleTransition is a change of a module's state. The flag files in the
+// module directory (disable, update, remove, skip_mount) are only created
+// or deleted through transitionModule, so every change is checked against
+// the rules below and ends up in the module event log.
+type moduleTransition string
+
+const (
+	transitionEnable  moduleTransition = "enable"
+	transitionDisable moduleTransition = "disable"
+	transitionRemove  moduleTransition = "remove"
+	transitionRestore moduleTransition = "restore"
+	transitionUpdate  moduleTransition = "update"
+	transitionUpdated moduleTransition = "updated"
+	transitionPurge   moduleTransition = "purge"
+)
+
+// moduleTransitions are the transitions `apd module state` takes, the
+// others belong to the install and boot steps.
+var moduleTransitions = []moduleTransition{
+	transitionEnable,
+	transitionDisable,
+	transitionRemove,
+	transitionRestore,
+}
+
+type moduleState struct {
+	Installed bool `json:"installed"`
+	Disabled  bool `json:"disabled"`
+	Update    bool `json:"update"`
+	Remove    bool `json:"remove"`
+	SkipMount bool `json:"skip_mount"`
+}
+
+type moduleEvent struct {
+	Time       time.Time        `json:"time"`
+	Module     string           `json:"module"`
+	Transition moduleTransition `json:"transition"`
+	From       moduleState      `json:"from"`
+	To         moduleState      `json:"to"`
+}
+
+func readModuleState(id string) moduleState {
+	modulePath := filepath.Join(moduleDir, id)
+	info, err := os.Stat(modulePath)
+	if err != nil || !info.IsDir() {
+		return moduleState{}
+	}
+	return moduleState{
+		Installed: true,
+		Disabled:  fileExists(filepath.Join(modulePath, disableFileName)),
+		Update:    fileExists(filepath.Join(modulePath, updateFileName)),
+		Remove:    fileExists(filepath.Join(modulePath, removeFileName)),
+		SkipMount: fileExists(filepath.Join(modulePath, SKIP_MOUNT_FILE_NAME)),
+	}
+}
+
+// next returns the state a transition leads to, or an error when the
+// transition is not allowed from s.
+func (s moduleState) next(t moduleTransition) (moduleState, error) {
+	if !s.Installed && t != transitionUpdate {
+		return s, fmt.Errorf("module not found")
+	}
+	switch t {
+	case transitionEnable:
+		// enabling a module pending removal keeps it
+		s.Disabled = false
+		s.Remove = false
+	case transitionDisable:
+		s.Disabled = true
+	case transitionRemove:
+		s.Remove = true
+	case transitionRestore:
+		if !s.Remove {
+			return s, fmt.Errorf("module is not marked for removal")
+		}
+		s.Remove = false
+	case transitionUpdate:
+		// an update keeps the module disabled if it was, but a pending
+		// removal is dropped since the user asked for the new version
+		s.Installed = true
+		s.Update = true
+		s.Remove = false
+	case transitionUpdated:
+		s.Update = false
+	case transitionPurge:
+		if !s.Remove {
+			return s, fmt.Errorf("module is not marked for removal")
+		}
+		s = moduleState{}
+	default:
+		return s, fmt.Errorf("unknown transition %q", t)
+	}
+	return s, nil
+}
+
+// checkModuleID rejects ids that are not a single path element of the
+// module directory, before they are joined into any path.
+func checkModuleID(id string) error {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id || !moduleIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid module id %q", id)
+	}
+	return nil
+}
+
+// transitionModule applies t to the module's flag files. The caller holds
+// the modules lock. Flags are written in an order that never leaves a
+// module enabled on the way to being disabled or removed.
+func transitionModule(id string, t moduleTransition) error {
+	if err := checkModuleID(id); err != nil {
+		return err
+	}
+	from := readModuleState(id)
+	to, err := from.next(t)
+	if err != nil {
+		return fmt.Errorf("module %s: cannot %s: %w", id, t, err)
+	}
+
+	modulePath := filepath.Join(moduleDir, id)
+	if t == transitionPurge {
+		if err := os.RemoveAll(modulePath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", modulePath, err)
+		}
+	} else {
+		if !from.Installed {
+			if err := os.MkdirAll(modulePath, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", modulePath, err)
+			}
+		}
+		flags := []struct {
+			name string
+			set  bool
+		}{
+			{disableFileName, to.Disabled},
+			{removeFileName, to.Remove},
+			{updateFileName, to.Update},
+			{SKIP_MOUNT_FILE_NAME, to.SkipMount},
+		}
+		if !to.Disabled {
+			// clear remove before disable when enabling a module
+			flags[0], flags[1] = flags[1], flags[0]
+		}
+		for _, flag := range flags {
+			if err := setModuleFlag(modulePath, flag.name, flag.set); err != nil {
+				return err
+			}
+		}
+	}
+
+	if to.Disabled && !from.Disabled || t == transitionPurge {
+		if err := revertSysctl(id); err != nil {
+			Error("failed to revert sysctl of %s: %v", id, err)
+		}
+	}
+
+	if from != to {
+		recordModuleEvent(moduleEvent{
+			Time:       time.Now(),
+			Module:     id,
+			Transition: t,
+			From:       from,
+			To:         to,
+		})
+	}
+	return nil
+}
+
+func setModuleFlag(modulePath, name string, set bool) error {
+	path := filepath.Join(modulePath, name)
+	if set {
+		if err := ensureFileExists(path); err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// recordModuleEvent logs the transition and appends it to the module
+// event log, which is rotated once it grows past moduleEventsMaxSize.
+func recordModuleEvent(event moduleEvent) {
+	Info("module %s: %s", event.Module, event.Transition)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(ap_log, 0700); err != nil {
+		return
+	}
+	if info, err := os.Stat(moduleEventsFile); err == nil && info.Size() > moduleEventsMaxSize {
+		os.Rename(moduleEventsFile, moduleEventsFile+".1")
+	}
+	file, err := os.OpenFile(moduleEventsFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		Warn("failed to open %s: %v", moduleEventsFile, err)
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
+
+// checkUserTransition rejects the internal transitions on the command
+// line. installer.sh marks the module it installs with update, it runs
+// with the lock of the installing apd.
+func checkUserTransition(t moduleTransition) error {
+	for _, allowed := range moduleTransitions {
+		if t == allowed {
+			return nil
+		}
+	}
+	if t == transitionUpdate && inheritedModulesLock() {
+		return nil
+	}
+	return fmt.Errorf("unknown transition %q, expected one of %s", t, moduleTransitionNames())
+}
+
+func moduleTransitionNames() string {
+	names := make([]string, len(moduleTransitions))
+	for i, t := range moduleTransitions {
+		names[i] = string(t)
+	}
+	return strings.Join(names, ", ")
+}
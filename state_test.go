@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestModuleStateNext(t *testing.T) {
+	installed := moduleState{Installed: true}
+	for _, tc := range []struct {
+		name    string
+		from    moduleState
+		t       moduleTransition
+		want    moduleState
+		wantErr bool
+	}{
+		{"enable clears a pending remove", moduleState{Installed: true, Disabled: true, Remove: true}, transitionEnable, installed, false},
+		{"disable", installed, transitionDisable, moduleState{Installed: true, Disabled: true}, false},
+		{"remove keeps disabled", moduleState{Installed: true, Disabled: true}, transitionRemove, moduleState{Installed: true, Disabled: true, Remove: true}, false},
+		{"restore", moduleState{Installed: true, Remove: true}, transitionRestore, installed, false},
+		{"restore without remove", installed, transitionRestore, installed, true},
+		{"update keeps disabled", moduleState{Installed: true, Disabled: true, Remove: true}, transitionUpdate, moduleState{Installed: true, Disabled: true, Update: true}, false},
+		{"update installs", moduleState{}, transitionUpdate, moduleState{Installed: true, Update: true}, false},
+		{"updated", moduleState{Installed: true, Update: true}, transitionUpdated, installed, false},
+		{"purge", moduleState{Installed: true, Disabled: true, Remove: true}, transitionPurge, moduleState{}, false},
+		{"purge without remove", installed, transitionPurge, installed, true},
+		{"not installed", moduleState{}, transitionEnable, moduleState{}, true},
+		{"unknown transition", installed, "bogus", installed, true},
+	} {
+		got, err := tc.from.next(tc.t)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// apdStatus is printed by `apd status` for manager apps.
+type apdStatus struct {
+	Version        string                  `json:"version"`
+	BootID         string                  `json:"boot_id"`
+	Stage          string                  `json:"stage"`
+	Stages         map[string]*stageRecord `json:"stages"`
+	SafeMode       bool                    `json:"safe_mode"`
+	SafeModeReason string                  `json:"safe_mode_reason,omitempty"`
+}
+
+func getStatus() *apdStatus {
+	status := &apdStatus{Version: Version}
+
+	stages := readStageState()
+	status.BootID = stages.BootID
+	status.Stage = stages.latestStage()
+	status.Stages = stages.Stages
+
+	if state, err := readSafeMode(); err == nil {
+		status.SafeMode = state.SafeMode
+		status.SafeModeReason = state.Reason
+	} else {
+		status.SafeMode, status.SafeModeReason = detectSafeMode(nil, false)
+	}
+	return status
+}
@@ -316,3 +316,23 @@ func scSuGetSafemode(key string) int64 {
 	}
 	return int64(ret)
 }
+func scKernelPatchVersion(key string) int64 {
+	if len(key) == 0 {
+		return 0
+	}
+
+	cKey := append([]byte(key), 0)
+	keyPtr := unsafe.Pointer(&cKey[0])
+
+	ret, _, errno := syscall.RawSyscall(
+		uintptr(__NR_SUPERCALL),
+		uintptr(keyPtr),
+		uintptr(verAndCmd(key, SUPERCALL_KERNELPATCH_VER)),
+		0,
+	)
+
+	if errno != 0 {
+		return -int64(errno)
+	}
+	return int64(ret)
+}
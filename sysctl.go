@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const moduleSysctlConf = "sysctl.conf"
+
+var sysctlKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-/]*$`)
+
+type sysctlEntry struct {
+	module string
+	key    string
+	value  string
+	stage  string
+	line   int
+}
+
+// sysctlBackup remembers, for the current boot, the value each key had
+// before a module changed it, so disabling the module can put it back.
+type sysctlBackup struct {
+	BootID string                        `json:"boot_id"`
+	Keys   map[string]*sysctlBackupEntry `json:"keys"`
+}
+
+type sysctlBackupEntry struct {
+	Module   string `json:"module"`
+	Previous string `json:"previous"`
+	Value    string `json:"value"`
+}
+
+func sysctlPath(key string) string {
+	if strings.Contains(key, "/") {
+		return filepath.Join("/proc/sys", key)
+	}
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+func validateSysctlKey(key string) error {
+	if !sysctlKeyPattern.MatchString(key) || strings.Contains(key, "..") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	info, err := os.Stat(sysctlPath(key))
+	if err != nil {
+		return fmt.Errorf("unknown key %q", key)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a sysctl value", key)
+	}
+	return nil
+}
+
+// parseSysctlConf reads "key = value" lines. A "[stage]" header moves the
+// following keys to that stage, post-fs-data is the default.
+func parseSysctlConf(module string) ([]sysctlEntry, error) {
+	file, err := os.Open(filepath.Join(module, moduleSysctlConf))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []sysctlEntry
+	stage := "post-fs-data"
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			stage = strings.TrimSpace(line[1 : len(line)-1])
+			if stage != "post-fs-data" && stage != "service" && stage != "boot-completed" {
+				return nil, fmt.Errorf("line %d: unknown stage %q", lineNo, stage)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		entries = append(entries, sysctlEntry{
+			module: filepath.Base(module),
+			key:    strings.TrimSpace(parts[0]),
+			value:  strings.TrimSpace(parts[1]),
+			stage:  stage,
+			line:   lineNo,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+func readSysctlBackup() *sysctlBackup {
+	bootID := currentBootID()
+	backup := &sysctlBackup{}
+	if data, err := os.ReadFile(sysctlBackupFile); err == nil {
+		json.Unmarshal(data, backup)
+	}
+	if backup.BootID != bootID || backup.Keys == nil {
+		backup = &sysctlBackup{BootID: bootID, Keys: map[string]*sysctlBackupEntry{}}
+	}
+	return backup
+}
+
+func writeSysctlBackup(backup *sysctlBackup) error {
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sysctlBackupFile, data, 0600)
+}
+
+// applySysctl writes the sysctl.conf entries of every enabled module that
+// belong to the given stage. When several modules set the same key the
+// conflict is reported and the last module in module order wins.
+func applySysctl(stage string) error {
+	winners := map[string]sysctlEntry{}
+	var order []string
+
+	err := foreachModuleStep(stage+" sysctl.conf", true, func(module string) error {
+		if !fileExists(filepath.Join(module, moduleSysctlConf)) {
+			return nil
+		}
+		entries, err := parseSysctlConf(module)
+		if err != nil {
+			Error("module %s: invalid %s: %v", filepath.Base(module), moduleSysctlConf, err)
+			return nil
+		}
+		for _, entry := range entries {
+			if entry.stage != stage {
+				continue
+			}
+			if err := validateSysctlKey(entry.key); err != nil {
+				Error("module %s: %s line %d: %v", entry.module, moduleSysctlConf, entry.line, err)
+				continue
+			}
+			if previous, ok := winners[entry.key]; ok {
+				if previous.module != entry.module && previous.value != entry.value {
+					Warn("sysctl conflict on %s: %s sets %q, %s sets %q, using %s",
+						entry.key, previous.module, previous.value, entry.module, entry.value, entry.module)
+				}
+			} else {
+				order = append(order, entry.key)
+			}
+			winners[entry.key] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	backup := readSysctlBackup()
+	for _, key := range order {
+		entry := winners[key]
+		path := sysctlPath(key)
+
+		current, err := os.ReadFile(path)
+		if err != nil {
+			Error("failed to read %s: %v", path, err)
+			continue
+		}
+		if err := os.WriteFile(path, []byte(entry.value), 0644); err != nil {
+			Error("module %s: failed to set %s: %v", entry.module, key, err)
+			continue
+		}
+		Info("module %s: %s = %s", entry.module, key, entry.value)
+
+		if recorded, ok := backup.Keys[key]; ok {
+			recorded.Module = entry.module
+			recorded.Value = entry.value
+		} else {
+			backup.Keys[key] = &sysctlBackupEntry{
+				Module:   entry.module,
+				Previous: strings.TrimSpace(string(current)),
+				Value:    entry.value,
+			}
+		}
+	}
+	return writeSysctlBackup(backup)
+}
+
+// revertSysctl restores the values a module changed during this boot.
+func revertSysctl(id string) error {
+	if !fileExists(sysctlBackupFile) {
+		return nil
+	}
+	backup := readSysctlBackup()
+
+	changed := false
+	for key, entry := range backup.Keys {
+		if entry.Module != id {
+			continue
+		}
+		if err := os.WriteFile(sysctlPath(key), []byte(entry.Previous), 0644); err != nil {
+			Error("module %s: failed to revert %s: %v", id, key, err)
+			continue
+		}
+		Info("module %s: reverted %s to %s", id, key, entry.Previous)
+		delete(backup.Keys, key)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return writeSysctlBackup(backup)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Module signatures are Ed25519ph (Ed25519 over the SHA-512 of the zip).
+// The signature is either kept next to the zip in <zip>.sig, or embedded
+// in the zip comment as "apd-signature:v1:<base64>". An embedded
+// signature covers the zip as it was before the comment was added, i.e.
+// with an empty comment.
+const (
+	trustKeySuffix      = ".pub"
+	trustCommentPrefix  = "apd-signature:v1:"
+	trustDefaultPolicy  = "warn"
+	zipEndOfCentralDir  = 0x06054b50
+	zipEndOfCentralSize = 22
+)
+
+var trustPolicies = []string{"off", "warn", "enforce"}
+
+var trustKeyNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type trustKey struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	key         ed25519.PublicKey
+}
+
+// parseTrustKey accepts a PEM encoded PKIX public key or the base64 of
+// the raw 32 byte key.
+func parseTrustKey(data []byte) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 public key")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("neither PEM nor base64: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d key bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func trustFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func listTrustKeys() ([]trustKey, error) {
+	entries, err := os.ReadDir(trustDir)
+	if os.IsNotExist(err) {
+		return []trustKey{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := []trustKey{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), trustKeySuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(trustDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseTrustKey(data)
+		if err != nil {
+			Warn("ignoring trust key %s: %v", entry.Name(), err)
+			continue
+		}
+		keys = append(keys, trustKey{
+			Name:        strings.TrimSuffix(entry.Name(), trustKeySuffix),
+			Fingerprint: trustFingerprint(key),
+			key:         key,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// addTrustKey stores a key, source is a key file or the key itself.
+func addTrustKey(name, source string) (*trustKey, error) {
+	if !trustKeyNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		data = []byte(source)
+	}
+	key, err := parseTrustKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(trustDir, 0700); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := writeFileAtomic(filepath.Join(trustDir, name+trustKeySuffix), []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	Info("trusted key %s (%s)", name, trustFingerprint(key))
+	return &trustKey{Name: name, Fingerprint: trustFingerprint(key), key: key}, nil
+}
+
+func removeTrustKey(name string) error {
+	if !trustKeyNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	if err := os.Remove(filepath.Join(trustDir, name+trustKeySuffix)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("key %s not found", name)
+		}
+		return err
+	}
+	Info("removed trust key %s", name)
+	return nil
+}
+
+func readTrustPolicy() string {
+	data, err := os.ReadFile(trustPolicyFile)
+	if err != nil {
+		return trustDefaultPolicy
+	}
+	policy := strings.TrimSpace(string(data))
+	if !contains(trustPolicies, policy) {
+		Warn("unknown trust policy %q, using %s", policy, trustDefaultPolicy)
+		return trustDefaultPolicy
+	}
+	return policy
+}
+
+func setTrustPolicy(policy string) error {
+	if !contains(trustPolicies, policy) {
+		return fmt.Errorf("unknown policy %q, expected one of %s", policy, strings.Join(trustPolicies, ", "))
+	}
+	if err := os.MkdirAll(trustDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(trustPolicyFile, []byte(policy+"\n"), 0600)
+}
+
+// signedDigest returns the SHA-512 of the signed zip content and the
+// signature found for it.
+func signedDigest(zipPath string) ([]byte, []byte, error) {
+	if data, err := os.ReadFile(zipPath + ".sig"); err == nil {
+		sig, err := decodeSignature(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s.sig: %w", zipPath, err)
+		}
+		file, err := os.Open(zipPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+		hash := sha512.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return nil, nil, err
+		}
+		return hash.Sum(nil), sig, nil
+	}
+	return embeddedSignedDigest(zipPath)
+}
+
+func embeddedSignedDigest(zipPath string) ([]byte, []byte, error) {
+	file, err := os.Open(zipPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the comment is at most 64k and ends the file
+	tailSize := int64(zipEndOfCentralSize + 0xffff)
+	if tailSize > info.Size() {
+		tailSize = info.Size()
+	}
+	tail := make([]byte, tailSize)
+	if _, err := file.ReadAt(tail, info.Size()-tailSize); err != nil {
+		return nil, nil, err
+	}
+	marker := bytes.LastIndex(tail, []byte(trustCommentPrefix))
+	eocd := marker - zipEndOfCentralSize
+	if marker < 0 || eocd < 0 || binary.LittleEndian.Uint32(tail[eocd:]) != zipEndOfCentralDir ||
+		int(binary.LittleEndian.Uint16(tail[eocd+20:])) != len(tail)-marker {
+		return nil, nil, errors.New("module is not signed")
+	}
+	sig, err := decodeSignature(tail[marker+len(trustCommentPrefix):])
+	if err != nil {
+		return nil, nil, fmt.Errorf("embedded signature: %w", err)
+	}
+
+	// hash the zip up to the comment, with a zero comment length
+	signedSize := info.Size() - tailSize + int64(eocd) + zipEndOfCentralSize
+	hash := sha512.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, signedSize-2)); err != nil {
+		return nil, nil, err
+	}
+	hash.Write([]byte{0, 0})
+	return hash.Sum(nil), sig, nil
+}
+
+func decodeSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("expected %d signature bytes, got %d", ed25519.SignatureSize, len(sig))
+	}
+	return sig, nil
+}
+
+// verifyModuleSignature returns the trusted key the zip is signed with.
+func verifyModuleSignature(zipPath string) (*trustKey, error) {
+	digest, sig, err := signedDigest(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := listTrustKeys()
+	if err != nil {
+		return nil, err
+	}
+	return matchTrustKey(keys, digest, sig)
+}
+
+func matchTrustKey(keys []trustKey, digest, sig []byte) (*trustKey, error) {
+	options := &ed25519.Options{Hash: crypto.SHA512}
+	for i := range keys {
+		if ed25519.VerifyWithOptions(keys[i].key, digest, sig, options) == nil {
+			return &keys[i], nil
+		}
+	}
+	return nil, errors.New("signature does not match any trusted key")
+}
+
+// checkModuleTrust applies the trust policy to a zip about to be
+// installed.
+func checkModuleTrust(zipPath string) error {
+	policy := readTrustPolicy()
+	if policy == "off" {
+		return nil
+	}
+	key, err := verifyModuleSignature(zipPath)
+	if err == nil {
+		Info("%s is signed by %s (%s)", zipPath, key.Name, key.Fingerprint)
+		fmt.Printf("- Signed by %s (%s)\n", key.Name, key.Fingerprint)
+		return nil
+	}
+	if policy == "enforce" {
+		Error("%s: %v", zipPath, err)
+		return fmt.Errorf("untrusted module: %w", err)
+	}
+	Warn("%s: %v", zipPath, err)
+	fmt.Printf("! Warning: %v\n", err)
+	return nil
+}
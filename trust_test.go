@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testZip returns a small zip with an empty comment.
+func testZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	file, err := writer.Create("module.prop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("id=example\n"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testSign(t *testing.T, key ed25519.PrivateKey, data []byte) []byte {
+	t.Helper()
+	digest := sha512.Sum512(data)
+	sig, err := key.Sign(nil, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// testEmbed appends the signature as the zip comment.
+func testEmbed(data, sig []byte) []byte {
+	comment := trustCommentPrefix + base64.StdEncoding.EncodeToString(sig)
+	signed := bytes.Clone(data)
+	binary.LittleEndian.PutUint16(signed[len(signed)-2:], uint16(len(comment)))
+	return append(signed, comment...)
+}
+
+func testKeys(t *testing.T) (ed25519.PrivateKey, []trustKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, []trustKey{{Name: "test", Fingerprint: trustFingerprint(public), key: public}}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignedDigestAccepts(t *testing.T) {
+	private, keys := testKeys(t)
+	data := testZip(t)
+	sig := testSign(t, private, data)
+	dir := t.TempDir()
+
+	embedded := filepath.Join(dir, "embedded.zip")
+	writeTestFile(t, embedded, testEmbed(data, sig))
+
+	detached := filepath.Join(dir, "detached.zip")
+	writeTestFile(t, detached, data)
+	writeTestFile(t, detached+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"))
+
+	for _, zipPath := range []string{embedded, detached} {
+		digest, found, err := signedDigest(zipPath)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(zipPath), err)
+		}
+		key, err := matchTrustKey(keys, digest, found)
+		if err != nil || key.Name != "test" {
+			t.Fatalf("%s: expected the test key, got %v, %v", filepath.Base(zipPath), key, err)
+		}
+	}
+}
+
+func TestSignedDigestRejectsMalformedComment(t *testing.T) {
+	private, _ := testKeys(t)
+	data := testZip(t)
+	signed := testEmbed(data, testSign(t, private, data))
+
+	appended := append(bytes.Clone(signed), "extra"...)
+	mismatched := bytes.Clone(signed)
+	eocd := len(data) - zipEndOfCentralSize
+	length := binary.LittleEndian.Uint16(mismatched[eocd+20:])
+	binary.LittleEndian.PutUint16(mismatched[eocd+20:], length+1)
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"appended.zip":   appended,
+		"mismatched.zip": mismatched,
+	} {
+		zipPath := filepath.Join(dir, name)
+		writeTestFile(t, zipPath, content)
+		if _, _, err := signedDigest(zipPath); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMatchTrustKeyRejectsUntrusted(t *testing.T) {
+	_, keys := testKeys(t)
+	other, _ := testKeys(t)
+	data := testZip(t)
+	zipPath := filepath.Join(t.TempDir(), "module.zip")
+	writeTestFile(t, zipPath, testEmbed(data, testSign(t, other, data)))
+
+	digest, sig, err := signedDigest(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := matchTrustKey(keys, digest, sig); err == nil {
+		t.Fatalf("expected no trusted key, got %s", key.Name)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// uninstallModule marks a module for removal at the next boot. With now
+// set the module is removed right away instead: uninstall.sh runs, its
+// files are unmounted and the directory is deleted.
+func uninstallModule(id string, now bool) error {
+	if err := transitionModule(id, transitionRemove); err != nil {
+		return err
+	}
+	if !now {
+		Info("module %s will be removed on the next reboot", id)
+		return nil
+	}
+
+	modulePath := filepath.Join(moduleDir, id)
+	runUninstaller(modulePath)
+
+	if err := unmountModule(id); err != nil {
+		Error("failed to unmount %s: %v", id, err)
+	}
+
+	if err := transitionModule(id, transitionPurge); err != nil {
+		return err
+	}
+	updatedPath := filepath.Join(moduleupdateDir, id)
+	if err := os.RemoveAll(updatedPath); err != nil {
+		Error("failed to remove %s: %v", updatedPath, err)
+	}
+	return nil
+}
+
+func restoreModule(id string) error {
+	return transitionModule(id, transitionRestore)
+}
+
+// moduleMounts returns the mount points in init's mount namespace whose
+// source lies inside the module directory, deepest first so they can be
+// unmounted in order.
+func moduleMounts(id string) ([]string, error) {
+	file, err := os.Open("/proc/1/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// mountinfo shows the root relative to its filesystem, /data being a
+	// mount of its own the module files appear as /adb/modules/<id>/...
+	inModule := func(path string) bool {
+		for _, dir := range []string{filepath.Join(moduleDir, id), filepath.Join("/adb/modules", id)} {
+			if path == dir || strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		root := unescapeMountPath(fields[3])
+		mountPoint := unescapeMountPath(fields[4])
+		if inModule(root) || inModule(mountPoint) {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(mounts)-1; i < j; i, j = i+1, j-1 {
+		mounts[i], mounts[j] = mounts[j], mounts[i]
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escaping of spaces, tabs, newlines
+// and backslashes in mountinfo.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// unmountModule detaches the module's mounts in init's mount namespace,
+// where the boot stages mounted them. A Go process can't setns into a
+// mount namespace, the unmounts run through nsenter.
+func unmountModule(id string) error {
+	mounts, err := moduleMounts(id)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, mountPoint := range mounts {
+		cmd := exec.Command(busybox, "nsenter", "-t", "1", "-m", "--", "umount", "-l", mountPoint)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			Warn("failed to unmount %s: %v: %s", mountPoint, err, strings.TrimSpace(string(output)))
+			failed = append(failed, mountPoint)
+			continue
+		}
+		Info("unmounted %s", mountPoint)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d mounts still busy: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
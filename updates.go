@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// updateInfo is the update JSON a module points to with updateJson, in
+// the format Magisk and KernelSU managers use. sha256 is an apd addition.
+type updateInfo struct {
+	Version     string `json:"version"`
+	VersionCode int64  `json:"versionCode"`
+	ZipUrl      string `json:"zipUrl"`
+	Changelog   string `json:"changelog"`
+	Sha256      string `json:"sha256,omitempty"`
+}
+
+type updateCacheEntry struct {
+	UpdateJson string      `json:"updateJson"`
+	CheckedAt  time.Time   `json:"checked_at"`
+	Info       *updateInfo `json:"info,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type moduleUpdate struct {
+	ID                   string      `json:"id"`
+	InstalledVersion     string      `json:"installed_version"`
+	InstalledVersionCode int64       `json:"installed_versionCode"`
+	Latest               *updateInfo `json:"latest,omitempty"`
+	Available            bool        `json:"available"`
+	Ignored              bool        `json:"ignored,omitempty"`
+	Cached               bool        `json:"cached"`
+	CheckedAt            time.Time   `json:"checked_at"`
+	Error                string      `json:"error,omitempty"`
+}
+
+// expired reports whether a cached check has to be done again.
+func (e *updateCacheEntry) expired() bool {
+	ttl := updateCacheTTL
+	if e.Error != "" {
+		ttl = updateErrorCacheTTL
+	}
+	return time.Since(e.CheckedAt) > ttl
+}
+
+var updateClient = &http.Client{Timeout: updateFetchTimeout}
+
+// fetchUpdateInfo downloads and parses an update JSON. Only http and https
+// are accepted, plain http is handy for testing against a local server.
+func fetchUpdateInfo(rawURL string) (*updateInfo, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported updateJson scheme %q", parsed.Scheme)
+	}
+
+	resp, err := updateClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+
+	info := &updateInfo{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(info); err != nil {
+		return nil, fmt.Errorf("%s: invalid update json: %w", rawURL, err)
+	}
+	if info.VersionCode <= 0 || info.ZipUrl == "" {
+		return nil, fmt.Errorf("%s: versionCode and zipUrl are required", rawURL)
+	}
+	return info, nil
+}
+
+func readUpdateCache() map[string]*updateCacheEntry {
+	cache := map[string]*updateCacheEntry{}
+	if data, err := os.ReadFile(updateCacheFile); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+func writeUpdateCache(cache map[string]*updateCacheEntry) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(updateCacheFile, data, 0600)
+}
+
+func readUpdateIgnore() []string {
+	data, err := os.ReadFile(updateIgnoreFile)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// setUpdateIgnore opts a module out of update checks, or back in.
+func setUpdateIgnore(id string, ignore bool) error {
+	var ids []string
+	for _, ignored := range readUpdateIgnore() {
+		if ignored != id {
+			ids = append(ids, ignored)
+		}
+	}
+	if ignore {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	data := strings.Join(ids, "\n")
+	if len(ids) > 0 {
+		data += "\n"
+	}
+	return writeFileAtomic(updateIgnoreFile, []byte(data), 0600)
+}
+
+// checkModuleUpdate returns the update status of one module, from the
+// cache when it was checked within updateCacheTTL, or updateErrorCacheTTL
+// when that check failed.
+func checkModuleUpdate(prop *ModuleProp, cache map[string]*updateCacheEntry, force bool) moduleUpdate {
+	update := moduleUpdate{
+		ID:                   prop.ID,
+		InstalledVersion:     prop.Version,
+		InstalledVersionCode: prop.VersionCode,
+	}
+
+	entry, ok := cache[prop.ID]
+	if force || !ok || entry.UpdateJson != prop.UpdateJson || entry.expired() {
+		entry = &updateCacheEntry{UpdateJson: prop.UpdateJson, CheckedAt: time.Now()}
+		info, err := fetchUpdateInfo(prop.UpdateJson)
+		if err != nil {
+			Warn("update check of %s failed: %v", prop.ID, err)
+			entry.Error = err.Error()
+		}
+		entry.Info = info
+		cache[prop.ID] = entry
+	} else {
+		update.Cached = true
+	}
+
+	update.CheckedAt = entry.CheckedAt
+	update.Error = entry.Error
+	update.Latest = entry.Info
+	update.Available = entry.Info != nil && entry.Info.VersionCode > prop.VersionCode
+	return update
+}
+
+// updatableModules lists the enabled modules declaring updateJson.
+func updatableModules() ([]ModuleInfo, error) {
+	var modules []ModuleInfo
+	err := withModulesLock(false, func() (err error) {
+		modules, err = listModules()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	modules, err = filterModules(modules, "enabled")
+	if err != nil {
+		return nil, err
+	}
+	updatable := []ModuleInfo{}
+	for _, module := range modules {
+		if module.UpdateJson != "" && !module.Remove {
+			updatable = append(updatable, module)
+		}
+	}
+	return updatable, nil
+}
+
+func ignoredModuleUpdate(prop *ModuleProp) moduleUpdate {
+	return moduleUpdate{
+		ID:                   prop.ID,
+		InstalledVersion:     prop.Version,
+		InstalledVersionCode: prop.VersionCode,
+		Ignored:              true,
+	}
+}
+
+// checkUpdates checks every enabled module declaring updateJson.
+func checkUpdates(force bool) ([]moduleUpdate, error) {
+	modules, err := updatableModules()
+	if err != nil {
+		return nil, err
+	}
+
+	cache := readUpdateCache()
+	ignored := readUpdateIgnore()
+	updates := []moduleUpdate{}
+	for i := range modules {
+		prop := &modules[i].ModuleProp
+		if contains(ignored, prop.ID) {
+			updates = append(updates, ignoredModuleUpdate(prop))
+			continue
+		}
+		updates = append(updates, checkModuleUpdate(prop, cache, force))
+	}
+
+	if err := writeUpdateCache(cache); err != nil {
+		Warn("failed to write %s: %v", updateCacheFile, err)
+	}
+	return updates, nil
+}
+
+func printModuleUpdates(updates []moduleUpdate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tINSTALLED\tLATEST\tSTATUS\tCHANGELOG")
+	for _, u := range updates {
+		latest, changelog := "-", "-"
+		if u.Latest != nil {
+			latest = fmt.Sprintf("%s (%d)", u.Latest.Version, u.Latest.VersionCode)
+			if u.Latest.Changelog != "" {
+				changelog = u.Latest.Changelog
+			}
+		}
+		status := "up to date"
+		switch {
+		case u.Ignored:
+			status = "ignored"
+		case u.Error != "":
+			status = "error: " + u.Error
+		case u.Available:
+			status = "update available"
+		}
+		fmt.Fprintf(w, "%s\t%s (%d)\t%s\t%s\t%s\n", u.ID, u.InstalledVersion, u.InstalledVersionCode,
+			latest, status, changelog)
+	}
+	w.Flush()
+}
+
+// findModuleUpdate checks a single module, bypassing the cache.
+func findModuleUpdate(id string) (*moduleUpdate, error) {
+	modules, err := updatableModules()
+	if err != nil {
+		return nil, err
+	}
+	for i := range modules {
+		prop := &modules[i].ModuleProp
+		if prop.ID != id {
+			continue
+		}
+		if contains(readUpdateIgnore(), id) {
+			update := ignoredModuleUpdate(prop)
+			return &update, nil
+		}
+		cache := readUpdateCache()
+		update := checkModuleUpdate(prop, cache, true)
+		if err := writeUpdateCache(cache); err != nil {
+			Warn("failed to write %s: %v", updateCacheFile, err)
+		}
+		return &update, nil
+	}
+	return nil, fmt.Errorf("module %s is not enabled or has no updateJson", id)
+}
+
+// downloadModuleUpdate fetches the zip of an update and checks the sha256
+// from the update JSON when there is one.
+func downloadModuleUpdate(id string, info *updateInfo) (string, error) {
+	parsed, err := url.Parse(info.ZipUrl)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("unsupported zipUrl scheme %q", parsed.Scheme)
+	}
+	if err := os.MkdirAll(updateDownloadDir, 0700); err != nil {
+		return "", err
+	}
+	zipPath := filepath.Join(updateDownloadDir, fmt.Sprintf("%s-%d.zip", id, info.VersionCode))
+
+	Info("downloading %s", info.ZipUrl)
+	client := &http.Client{Timeout: updateDownloadTimeout}
+	resp, err := client.Get(info.ZipUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", info.ZipUrl, resp.Status)
+	}
+	if resp.ContentLength > updateDownloadMaxSize {
+		return "", fmt.Errorf("%s: %d bytes, larger than %d", info.ZipUrl, resp.ContentLength, updateDownloadMaxSize)
+	}
+
+	file, err := os.OpenFile(zipPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(resp.Body, updateDownloadMaxSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > updateDownloadMaxSize {
+		err = fmt.Errorf("larger than %d bytes", updateDownloadMaxSize)
+	}
+	if err != nil {
+		os.Remove(zipPath)
+		return "", fmt.Errorf("failed to download %s: %w", info.ZipUrl, err)
+	}
+
+	if info.Sha256 != "" {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if !strings.EqualFold(sum, info.Sha256) {
+			os.Remove(zipPath)
+			return "", fmt.Errorf("sha256 mismatch: expected %s, got %s", info.Sha256, sum)
+		}
+		Info("sha256 of %s verified", zipPath)
+	} else {
+		Warn("update json of %s has no sha256, download not verified", id)
+	}
+	return zipPath, nil
+}
+
+// backupModule keeps a copy of the installed module for rollbackModule.
+func backupModule(id string) error {
+	backup := filepath.Join(moduleRollbackDir, id)
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(moduleRollbackDir, 0700); err != nil {
+		return err
+	}
+	cmd := exec.Command(busybox, "cp", "-a", filepath.Join(moduleDir, id), backup)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(backup)
+		return fmt.Errorf("failed to back up %s: %v: %s", id, err, strings.TrimSpace(string(output)))
+	}
+	Info("backed up %s to %s", id, backup)
+	return nil
+}
+
+// rollbackModule stages the backed up copy of a module like an update, so
+// it replaces the current version on the next boot.
+func rollbackModule(id string) error {
+	if err := checkModuleID(id); err != nil {
+		return err
+	}
+	if !readModuleState(id).Installed {
+		return fmt.Errorf("module %s not found", id)
+	}
+	backup := filepath.Join(moduleRollbackDir, id)
+	if !fileExists(backup) {
+		return fmt.Errorf("no previous version of %s kept", id)
+	}
+	staged := filepath.Join(moduleupdateDir, id)
+	if err := os.RemoveAll(staged); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(moduleupdateDir, 0755); err != nil {
+		return err
+	}
+	cmd := exec.Command(busybox, "cp", "-a", backup, staged)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(staged)
+		return fmt.Errorf("failed to stage %s: %v: %s", id, err, strings.TrimSpace(string(output)))
+	}
+	// flags of the backup describe the state at backup time, the live
+	// module carries the current ones
+	for _, flag := range []string{disableFileName, updateFileName, removeFileName} {
+		os.Remove(filepath.Join(staged, flag))
+	}
+	if err := transitionModule(id, transitionUpdate); err != nil {
+		return err
+	}
+	if err := journalModule(id, journalStaged, func(entry *journalEntry) {
+		entry.Zip = ""
+		if prop, err := loadModuleProp(staged); err == nil {
+			entry.Version = prop.Version
+			entry.VersionCode = prop.VersionCode
+		}
+	}); err != nil {
+		Error("failed to write install journal: %v", err)
+	}
+	Info("%s will be rolled back on the next reboot", id)
+	return nil
+}
+
+// updateModule downloads the latest version of a module and stages it
+// through installModule.
+func updateModule(id string) error {
+	update, err := findModuleUpdate(id)
+	if err != nil {
+		return err
+	}
+	if update.Ignored {
+		fmt.Printf("%s is ignored, run `apd module check-updates --unignore %s` to update it\n", id, id)
+		return nil
+	}
+	if update.Error != "" {
+		return fmt.Errorf("update check failed: %s", update.Error)
+	}
+	if !update.Available {
+		fmt.Printf("%s is up to date (%s)\n", id, update.InstalledVersion)
+		return nil
+	}
+	fmt.Printf("- Updating %s: %s -> %s\n", id, update.InstalledVersion, update.Latest.Version)
+
+	zipPath, err := downloadModuleUpdate(id, update.Latest)
+	if err != nil {
+		return err
+	}
+	// installModule works on its own copy
+	defer os.Remove(zipPath)
+	if err := withModulesLock(true, func() error { return backupModule(id) }); err != nil {
+		return err
+	}
+	return installModule(zipPath)
+}
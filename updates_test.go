@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// updateServer serves an update JSON and counts the requests. It fails
+// with 500 while failing is set.
+func updateServer(t *testing.T, versionCode int64) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	t.Helper()
+	var hits atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"version":"v%d","versionCode":%d,"zipUrl":"http://%s/module.zip"}`,
+			versionCode, versionCode, r.Host)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits, &failing
+}
+
+func testModuleProp(updateJson string, versionCode int64) *ModuleProp {
+	return &ModuleProp{ID: "example", Version: "v1", VersionCode: versionCode, UpdateJson: updateJson}
+}
+
+func TestCheckModuleUpdate(t *testing.T) {
+	server, hits, _ := updateServer(t, 2)
+	cache := map[string]*updateCacheEntry{}
+
+	update := checkModuleUpdate(testModuleProp(server.URL, 1), cache, false)
+	if update.Error != "" {
+		t.Fatalf("unexpected error: %s", update.Error)
+	}
+	if !update.Available || update.Cached {
+		t.Fatalf("expected a fresh available update, got %+v", update)
+	}
+	if update.Latest.VersionCode != 2 || update.Latest.Version != "v2" {
+		t.Fatalf("unexpected latest version %+v", update.Latest)
+	}
+
+	update = checkModuleUpdate(testModuleProp(server.URL, 2), cache, false)
+	if update.Available {
+		t.Fatalf("installed version is the latest, got %+v", update)
+	}
+	if !update.Cached || hits.Load() != 1 {
+		t.Fatalf("expected the cached result, %d requests made", hits.Load())
+	}
+}
+
+func TestCheckModuleUpdateRefetches(t *testing.T) {
+	server, hits, _ := updateServer(t, 2)
+	cache := map[string]*updateCacheEntry{}
+	prop := testModuleProp(server.URL, 1)
+
+	checkModuleUpdate(prop, cache, false)
+	if update := checkModuleUpdate(prop, cache, true); update.Cached {
+		t.Fatalf("force must bypass the cache")
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("expected 2 requests, got %d", hits.Load())
+	}
+
+	cache[prop.ID].CheckedAt = time.Now().Add(-updateCacheTTL - time.Minute)
+	if update := checkModuleUpdate(prop, cache, false); update.Cached {
+		t.Fatalf("an expired entry must be checked again")
+	}
+
+	if update := checkModuleUpdate(testModuleProp(server.URL+"/other.json", 1), cache, false); update.Cached {
+		t.Fatalf("a changed updateJson must be checked again")
+	}
+	if hits.Load() != 4 {
+		t.Fatalf("expected 4 requests, got %d", hits.Load())
+	}
+}
+
+func TestCheckModuleUpdateErrorCachedBriefly(t *testing.T) {
+	server, hits, failing := updateServer(t, 2)
+	cache := map[string]*updateCacheEntry{}
+	prop := testModuleProp(server.URL, 1)
+
+	failing.Store(true)
+	update := checkModuleUpdate(prop, cache, false)
+	if update.Error == "" || update.Available {
+		t.Fatalf("expected a failed check, got %+v", update)
+	}
+	if update = checkModuleUpdate(prop, cache, false); !update.Cached || update.Error == "" {
+		t.Fatalf("a recent failure is cached, got %+v", update)
+	}
+
+	failing.Store(false)
+	cache[prop.ID].CheckedAt = time.Now().Add(-updateErrorCacheTTL - time.Second)
+	update = checkModuleUpdate(prop, cache, false)
+	if update.Cached || update.Error != "" || !update.Available {
+		t.Fatalf("a failure must not be kept for %s, got %+v", updateCacheTTL, update)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("expected 2 requests, got %d", hits.Load())
+	}
+}
+
+func TestFetchUpdateInfoRejects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/incomplete.json":
+			fmt.Fprint(w, `{"version":"v2","versionCode":2}`)
+		default:
+			fmt.Fprint(w, `not json`)
+		}
+	}))
+	defer server.Close()
+
+	for _, rawURL := range []string{
+		"file:///data/adb/update.json",
+		server.URL + "/incomplete.json",
+		server.URL + "/invalid.json",
+	} {
+		if _, err := fetchUpdateInfo(rawURL); err == nil {
+			t.Errorf("%s: expected an error", rawURL)
+		}
+	}
+}
+
+func TestRollbackModuleRejectsInvalidID(t *testing.T) {
+	for _, id := range []string{"", ".", "..", "a/b", "../modules", "/data"} {
+		if err := rollbackModule(id); err == nil || !strings.Contains(err.Error(), "invalid module id") {
+			t.Errorf("rollbackModule(%q): expected an invalid id error, got %v", id, err)
+		}
+	}
+}
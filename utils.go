@@ -68,30 +68,27 @@ func ensureDirExists(dir string) error {
 	}
 	return nil
 }
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tempPath, err)
+	}
+	return nil
+}
 func ensureBinary(path string) error {
 	return os.Chmod(path, 0755)
 }
 func isSafeMode(superkey *string) bool {
-	safemode, err := getprop("persist.sys.safemode")
-	if err == nil && safemode == "1" {
-		Info("safemode: true")
-		return true
-	}
-	Info("safemode: false")
-	if superkey != nil {
-		ret := scSuGetSafemode(*superkey)
-		if ret == 1 {
-			Info("scSuGetSafemode: safemode active")
-			return true
-		} else if ret == 0 {
-			Info("scSuGetSafemode: normal mode")
-			return false
-		} else {
-			Error("scSuGetSafemode failed: %d", ret)
-			return false
-		}
+	if state, err := readSafeMode(); err == nil {
+		Info("safemode: %t (recorded)", state.SafeMode)
+		return state.SafeMode
 	}
-	return false
+	safeMode, reason := detectSafeMode(superkey, false)
+	Info("safemode: %t %s", safeMode, reason)
+	return safeMode
 }
 func isOverlayFSSupported() (bool, error) {
 	file, err := os.Open("/proc/filesystems")
@@ -119,17 +116,84 @@ func fileExists(filename string) bool {
 	}
 	return true
 }
-func getTmpPath() string {
-	if fileExists(temp_dir_legacy) {
-		return temp_dir_legacy
+func tmpPathFile() string {
+	return filepath.Join(runDir, "tmp_path")
+}
+
+// getTmpPath returns the private temp directory chosen by setupTmpPath for
+// this boot. There is no fallback: any other path has no private tmpfs
+// and the mount work dir would end up in the real ramdisk.
+func getTmpPath() (string, error) {
+	data, err := os.ReadFile(tmpPathFile())
+	if err != nil {
+		return "", fmt.Errorf("no tmp path set up for this boot: %w", err)
+	}
+	path := strings.TrimSpace(string(data))
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("recorded tmp path %s is gone", path)
+	}
+	return path, nil
+}
+
+// setupTmpPath mounts a fresh tmpfs on the first existing candidate, or on
+// a 0700 directory under runDir when none of them can be used, and records
+// the result for the rest of the boot.
+func setupTmpPath() (string, error) {
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return "", err
+	}
+
+	var chosen string
+	for _, candidate := range []string{temp_dir_legacy, temp_dir} {
+		if info, err := os.Stat(candidate); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := mountTmpfs(candidate, 0755); err != nil {
+			Warn("tmp path %s unusable: %v", candidate, err)
+			continue
+		}
+		chosen = candidate
+		break
+	}
+
+	if chosen == "" {
+		fallback := filepath.Join(runDir, "tmp")
+		if err := mountTmpfs(fallback, 0700); err != nil {
+			return "", fmt.Errorf("no usable tmp path: %s, %s and %s all failed: %w",
+				temp_dir_legacy, temp_dir, fallback, err)
+		}
+		chosen = fallback
+	}
+
+	if !isWritableDir(chosen) {
+		return "", fmt.Errorf("tmp path %s is not writable", chosen)
+	}
+	if err := writeFileAtomic(tmpPathFile(), []byte(chosen+"\n"), 0600); err != nil {
+		return chosen, fmt.Errorf("failed to record tmp path: %w", err)
+	}
+	Info("using tmp path %s", chosen)
+	return chosen, nil
+}
+
+func isWritableDir(dir string) bool {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false
 	}
-	if fileExists(temp_dir) {
-		return temp_dir
+	probe, err := os.CreateTemp(dir, ".apd_probe")
+	if err != nil {
+		return false
 	}
-	return ""
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
 }
-func getWorkDir() string {
-	return getTmpPath() + "/workdir/"
+
+func getWorkDir() (string, error) {
+	tmpPath, err := getTmpPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(tmpPath, "workdir"), nil
 }
 func switchCgroups(pid int) error {
 	//pid := os.Getpid()
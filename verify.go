@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// compression ratio above which an entry is reported as a possible zip bomb
+const verifyMaxRatio = 200
+
+// verifyTopLevel lists the top-level entries a module zip is expected to
+// contain. Anything else is reported as a warning.
+var verifyTopLevel = []string{
+	"META-INF", "common", "system", "vendor", "product", "system_ext", "odm",
+	moduleWebDir, kernelModulesDir, "zygisk",
+	"module.prop", "system.prop", "sepolicy.rule", moduleSysctlConf, modulePropHooks,
+	"customize.sh", "install.sh", "uninstall.sh", moduleActionSh,
+	"post-fs-data.sh", "post-mount.sh", "service.sh", "boot-completed.sh",
+	SKIP_MOUNT_FILE_NAME, "README.md", "LICENSE", "changelog.md", "update.json",
+}
+
+type verifyIssue struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+type verifyReport struct {
+	ID     string        `json:"id,omitempty"`
+	Issues []verifyIssue `json:"issues"`
+}
+
+func (r *verifyReport) error(path, format string, a ...interface{}) {
+	r.Issues = append(r.Issues, verifyIssue{Severity: "error", Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+func (r *verifyReport) warn(path, format string, a ...interface{}) {
+	r.Issues = append(r.Issues, verifyIssue{Severity: "warning", Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+func (r *verifyReport) ok() bool {
+	for _, issue := range r.Issues {
+		if issue.Severity == "error" {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *verifyReport) print(w io.Writer) {
+	for _, issue := range r.Issues {
+		if issue.Path != "" {
+			fmt.Fprintf(w, "%s: %s: %s\n", issue.Severity, issue.Path, issue.Message)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", issue.Severity, issue.Message)
+		}
+	}
+}
+
+// verifyModuleZip checks a module zip without extracting it and reports
+// every problem found. The error is only set when the zip can't be read.
+func verifyModuleZip(zipPath string) (*verifyReport, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	report := &verifyReport{Issues: []verifyIssue{}}
+	seen := map[string]bool{}
+	hasProp := false
+
+	for _, f := range r.File {
+		name := f.Name
+		if seen[name] {
+			report.error(name, "duplicate entry")
+		}
+		seen[name] = true
+
+		if !verifyEntryName(report, name) {
+			continue
+		}
+		clean := path.Clean(name)
+		top := strings.SplitN(clean, "/", 2)[0]
+		if !contains(verifyTopLevel, top) {
+			report.warn(name, "unexpected top-level entry %q", top)
+		}
+
+		if f.Mode()&os.ModeSymlink != 0 {
+			verifySymlink(report, f, clean)
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		if clean == "module.prop" {
+			hasProp = true
+			verifyModulePropEntry(report, f)
+		}
+		verifyEntrySize(report, f)
+	}
+
+	if !hasProp {
+		report.error("module.prop", "missing")
+	}
+	return report, nil
+}
+
+func verifyEntryName(report *verifyReport, name string) bool {
+	switch {
+	case name == "":
+		report.error(name, "empty entry name")
+	case strings.HasPrefix(name, "/"):
+		report.error(name, "absolute path")
+	case strings.Contains(name, "\\"):
+		report.error(name, "backslash in path")
+	case strings.Contains(name, "\x00"):
+		report.error(name, "NUL in path")
+	default:
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				report.error(name, "path traversal")
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func verifySymlink(report *verifyReport, f *zip.File, clean string) {
+	rc, err := f.Open()
+	if err != nil {
+		report.error(f.Name, "unreadable: %v", err)
+		return
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		report.error(f.Name, "unreadable: %v", err)
+		return
+	}
+
+	link := string(target)
+	if path.IsAbs(link) {
+		report.error(f.Name, "absolute symlink to %s", link)
+		return
+	}
+	resolved := path.Join(path.Dir(clean), link)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		report.error(f.Name, "symlink to %s points outside the module", link)
+	}
+}
+
+func verifyModulePropEntry(report *verifyReport, f *zip.File) {
+	rc, err := f.Open()
+	if err != nil {
+		report.error(f.Name, "unreadable: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	prop, err := parseModuleProp(rc)
+	if err != nil {
+		report.error(f.Name, "unreadable: %v", err)
+		return
+	}
+	report.ID = prop.ID
+	if err := prop.validate(); err != nil {
+		report.error(f.Name, "%v", err)
+	}
+	if prop.Name == "" {
+		report.error(f.Name, "name not set")
+	}
+	if prop.Version == "" {
+		report.error(f.Name, "version not set")
+	}
+	if prop.VersionCode == 0 && prop.versionCodeErr == nil {
+		report.error(f.Name, "versionCode not set")
+	}
+	if prop.Author == "" {
+		report.warn(f.Name, "author not set")
+	}
+	if prop.Description == "" {
+		report.warn(f.Name, "description not set")
+	}
+}
+
+// verifyEntrySize reads the entry to compare its size with the one
+// declared in the zip header, the reader also checks the CRC at EOF.
+func verifyEntrySize(report *verifyReport, f *zip.File) {
+	declared := f.UncompressedSize64
+	if f.CompressedSize64 > 0 && declared/f.CompressedSize64 > verifyMaxRatio {
+		report.warn(f.Name, "compression ratio above %d:1", verifyMaxRatio)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		report.error(f.Name, "unreadable: %v", err)
+		return
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(io.Discard, io.LimitReader(rc, int64(declared)+1))
+	switch {
+	case errors.Is(err, zip.ErrChecksum):
+		report.error(f.Name, "checksum mismatch")
+	case err != nil:
+		report.error(f.Name, "unreadable: %v", err)
+	case uint64(n) != declared:
+		report.error(f.Name, "declared size %d, read %d bytes", declared, n)
+	}
+}
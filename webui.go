@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	webUITokenCookie = "apd_webui_token"
+	webUITokenHeader = "X-APD-Token"
+	webUIBridgePath  = "/.apd/bridge.js"
+)
+
+// webUIBridge mimics the window.ksu object the KernelSU manager injects
+// into module web UIs, on top of the /.apd/ endpoints below.
+const webUIBridge = `(function () {
+  var moduleInfo = %s;
+  // the token is only in the served page, a page of another origin
+  // including this script does not get it
+  var meta = document.querySelector('meta[name="apd-token"]');
+  var token = meta ? meta.content : "";
+  function post(path, body) {
+    return fetch(path, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json", "X-APD-Token": token },
+      body: JSON.stringify(body)
+    });
+  }
+  function callback(name) {
+    var fn = window[name];
+    if (typeof fn === "function") fn.apply(window, Array.prototype.slice.call(arguments, 1));
+  }
+  window.ksu = {
+    exec: function (cmd, options, cb) {
+      if (typeof options === "string" && cb === undefined) { cb = options; options = "{}"; }
+      post("/.apd/exec", { cmd: cmd, options: JSON.parse(options || "{}") })
+        .then(function (r) { return r.json(); })
+        .then(function (r) { callback(cb, r.errno, r.stdout, r.stderr); })
+        .catch(function (e) { callback(cb, 1, "", String(e)); });
+    },
+    spawn: function (command, args, options, cb) {
+      // the kernelsu package registers window[cb] with stdout and
+      // stderr emitters before calling spawn
+      var target = window[cb];
+      post("/.apd/spawn", { command: command, args: JSON.parse(args || "[]"), options: JSON.parse(options || "{}") })
+        .then(function (r) {
+          var reader = r.body.getReader(), decoder = new TextDecoder(), buffered = "";
+          function pump() {
+            return reader.read().then(function (chunk) {
+              if (chunk.done) return;
+              buffered += decoder.decode(chunk.value, { stream: true });
+              var lines = buffered.split("\n");
+              buffered = lines.pop();
+              lines.forEach(function (line) {
+                if (!line) return;
+                var event = JSON.parse(line);
+                if (event.stream) target[event.stream].emit("data", event.line);
+                else if (event.error) target.emit("error", event.error);
+                else target.emit("exit", event.exit);
+              });
+              return pump();
+            });
+          }
+          return pump();
+        })
+        .catch(function (e) { target.emit("error", String(e)); });
+    },
+    toast: function (message) { console.log(message); },
+    fullScreen: function (enable) {},
+    moduleInfo: function () { return JSON.stringify(moduleInfo); }
+  };
+})();
+`
+
+type webUIServer struct {
+	id       string
+	webroot  string
+	token    string
+	cookie   string
+	host     string
+	env      []string
+	bridgeJS []byte
+}
+
+type webUIExecRequest struct {
+	Cmd     string        `json:"cmd"`
+	Options webUIExecOpts `json:"options"`
+	Command string        `json:"command"`
+	Args    []string      `json:"args"`
+}
+
+type webUIExecOpts struct {
+	Cwd string            `json:"cwd"`
+	Env map[string]string `json:"env"`
+}
+
+type webUIExecResult struct {
+	Errno  int    `json:"errno"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+func newWebUIToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// serveWebUI serves the module's webroot on loopback until apd is
+// interrupted. The URL printed on start carries the session token, the
+// first request trades it for a cookie.
+func serveWebUI(id string, superkey *string, port int) error {
+	if err := checkModuleID(id); err != nil {
+		return err
+	}
+	var prop *ModuleProp
+	err := withModulesLock(false, func() error {
+		state := readModuleState(id)
+		if !state.Installed {
+			return fmt.Errorf("module %s not found", id)
+		}
+		if state.Disabled || state.Remove {
+			return fmt.Errorf("module %s is not enabled", id)
+		}
+		var err error
+		prop, err = loadModuleProp(filepath.Join(moduleDir, id))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	modulePath := filepath.Join(moduleDir, id)
+	webroot, err := filepath.EvalSymlinks(filepath.Join(modulePath, moduleWebDir))
+	if err != nil {
+		return fmt.Errorf("module %s has no %s: %w", id, moduleWebDir, err)
+	}
+
+	token, err := newWebUIToken()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+
+	info, _ := json.Marshal(map[string]string{
+		"id":          prop.ID,
+		"name":        prop.Name,
+		"version":     prop.Version,
+		"versionCode": fmt.Sprint(prop.VersionCode),
+		"author":      prop.Author,
+		"description": prop.Description,
+		"moduleDir":   modulePath,
+	})
+	server := &webUIServer{
+		id:       id,
+		webroot:  webroot,
+		token:    token,
+		cookie:   fmt.Sprintf("%s_%d", webUITokenCookie, listener.Addr().(*net.TCPAddr).Port),
+		host:     listener.Addr().String(),
+		env:      moduleScriptEnv(scriptEnv("webui", superkey), modulePath),
+		bridgeJS: []byte(fmt.Sprintf(webUIBridge, info)),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(webUIBridgePath, server.serveBridge)
+	mux.HandleFunc("/.apd/exec", server.serveExec)
+	mux.HandleFunc("/.apd/spawn", server.serveSpawn)
+	mux.HandleFunc("/", server.serveFile)
+
+	httpServer := &http.Server{Handler: server.authenticate(mux)}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-signals
+		httpServer.Close()
+	}()
+
+	Info("webui of %s listening on %s", id, server.host)
+	fmt.Printf("http://%s/?token=%s\n", server.host, token)
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authenticate rejects requests without the session token and requests
+// for another Host, which keeps DNS rebinding pages out.
+func (s *webUIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != s.host {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if token := r.URL.Query().Get("token"); token != "" && s.validToken(token) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     s.cookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			query := r.URL.Query()
+			query.Del("token")
+			target := r.URL.Path
+			if encoded := query.Encode(); encoded != "" {
+				target += "?" + encoded
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		// cookies are shared between ports, every session has its own
+		cookie, err := r.Cookie(s.cookie)
+		if err != nil || !s.validToken(cookie.Value) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *webUIServer) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *webUIServer) serveBridge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(s.bridgeJS)
+}
+
+// serveFile serves files of the webroot, HTML pages get the bridge script
+// injected before anything else runs.
+func (s *webUIServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Join(s.webroot, filepath.FromSlash(filepath.Clean("/"+r.URL.Path)))
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil || (resolved != s.webroot && !strings.HasPrefix(resolved, s.webroot+string(os.PathSeparator))) {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := os.Stat(resolved); err == nil && info.IsDir() {
+		resolved = filepath.Join(resolved, "index.html")
+	}
+	if !strings.HasSuffix(resolved, ".html") && !strings.HasSuffix(resolved, ".htm") {
+		http.ServeFile(w, r, resolved)
+		return
+	}
+
+	page, err := os.ReadFile(resolved)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	script := []byte(fmt.Sprintf(`<meta name="apd-token" content="%s"><script src="%s"></script>`, s.token, webUIBridgePath))
+	if i := bytes.Index(bytes.ToLower(page), []byte("<head>")); i >= 0 {
+		i += len("<head>")
+		page = append(page[:i:i], append(script, page[i:]...)...)
+	} else {
+		page = append(script, page...)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page)
+}
+
+// decodeRequest checks exec and spawn requests on top of the cookie: any
+// page on 127.0.0.1 counts as same-site and gets the cookie sent, so the
+// request must also come from our origin, carry the token in a header and
+// be JSON, which a cross-origin page can't send without a preflight.
+func (s *webUIServer) decodeRequest(w http.ResponseWriter, r *http.Request) (*webUIExecRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if r.Header.Get("Origin") != "http://"+s.host || !s.validToken(r.Header.Get(webUITokenHeader)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	var req webUIExecRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+func (s *webUIServer) command(name string, args []string, opts webUIExecOpts) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = filepath.Join(moduleDir, s.id)
+	if opts.Cwd != "" {
+		cmd.Dir = opts.Cwd
+	}
+	cmd.Env = s.env
+	for key, value := range opts.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return cmd
+}
+
+func (s *webUIServer) serveExec(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	Info("webui %s: exec %s", s.id, req.Cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd := s.command(busybox, []string{"sh", "-c", req.Cmd}, req.Options)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	result := webUIExecResult{}
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.Errno = exitErr.ExitCode()
+		} else {
+			result.Errno = 1
+			stderr.WriteString(err.Error())
+		}
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveSpawn streams the command's output as JSON lines in the same shape
+// `apd module action --json` prints.
+func (s *webUIServer) serveSpawn(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	Info("webui %s: spawn %s %s", s.id, req.Command, strings.Join(req.Args, " "))
+
+	flusher, _ := w.(http.Flusher)
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	send := func(event map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	emit := func(stream, line string) {
+		send(map[string]interface{}{"stream": stream, "line": line})
+	}
+	stdout := &actionStream{emit: emit, stream: "stdout"}
+	stderr := &actionStream{emit: emit, stream: "stderr"}
+	cmd := s.command(req.Command, req.Args, req.Options)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = actionWaitDelay
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		send(map[string]interface{}{"exit": 0})
+	case errors.As(err, &exitErr):
+		send(map[string]interface{}{"exit": exitErr.ExitCode()})
+	default:
+		send(map[string]interface{}{"error": err.Error()})
+	}
+}